@@ -900,7 +900,7 @@ func (filter *filter) update(now time.Time) (bool, error) {
 			}
 		} else if len(line) != 0 {
 			err = d.AddRule(line, 0)
-			if err == dnsfilter.ErrInvalidSyntax {
+			if dnsfilter.IsRuleError(err) {
 				continue
 			}
 			if err != nil {
@@ -157,7 +157,7 @@ func setupPlugin(c *caddy.Controller) (*plug, error) {
 				continue
 			}
 			err = p.d.AddRule(text, uint32(i))
-			if err == dnsfilter.ErrInvalidSyntax {
+			if dnsfilter.IsRuleError(err) {
 				continue
 			}
 			if err != nil {
@@ -308,7 +308,7 @@ func doStatsLookup(ch interface{}, doFunc statsFunc, name string, lookupstats *d
 
 func (p *plug) doStats(ch interface{}, doFunc statsFunc) {
 	p.RLock()
-	stats := p.d.GetStats()
+	stats := p.d.StatsSnapshot()
 	doStatsLookup(ch, doFunc, "safebrowsing", &stats.Safebrowsing)
 	doStatsLookup(ch, doFunc, "parental", &stats.Parental)
 	p.RUnlock()
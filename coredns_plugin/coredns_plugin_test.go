@@ -142,6 +142,36 @@ func TestEtcHostsFilter(t *testing.T) {
 	}
 }
 
+func TestSetupSkipsBadRules(t *testing.T) {
+	text := []byte("||example.com^$dnsrewrite=SOMETHING\n" + "||doubleclick.net^\n")
+	tmpfile, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tmpfile.Write(text); err != nil {
+		t.Fatal(err)
+	}
+	if err = tmpfile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove(tmpfile.Name())
+
+	c := caddy.NewTestController("dns", fmt.Sprintf("dnsfilter %s", tmpfile.Name()))
+	p, err := setupPlugin(c)
+	if err != nil {
+		t.Fatalf("Expected bad $dnsrewrite rule to be skipped, got: %v", err)
+	}
+
+	ret, err := p.d.CheckHost("doubleclick.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ret.IsFiltered {
+		t.Fatal("Expected doubleclick.net to be filtered by the rule after the bad one")
+	}
+}
+
 func zeroTTLBackend() plugin.Handler {
 	return plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
 		m := new(dns.Msg)
@@ -0,0 +1,73 @@
+package dnsfilter
+
+import "sort"
+
+const coverageTopRules = 10 // number of rules reported in CoverageReport.TopRules
+
+// CoverageReport describes how much of a query log is filtered, see Coverage
+type CoverageReport struct {
+	Total    int            // number of checked hosts, including the ones that failed
+	Blocked  int            // number of hosts that were filtered
+	Errors   int            // number of hosts that couldn't be checked, e.g. invalid ones
+	ByReason map[Reason]int // number of filtered hosts by reason
+	TopRules []RuleCoverage // rules that filtered most hosts, most hits first
+}
+
+// RuleCoverage is a rule along with the number of hosts it filtered during Coverage
+type RuleCoverage struct {
+	ID   uint64
+	Text string // as reported in Result.Rule
+	Hits int
+}
+
+// Fraction returns the part of checked hosts that were filtered, from 0 to 1
+func (r CoverageReport) Fraction() float64 {
+	if r.Total == 0 {
+		return 0
+	}
+	return float64(r.Blocked) / float64(r.Total)
+}
+
+// Coverage checks each of hosts, e.g. from a captured query log, and reports how many of them are filtered and by what
+// it's meant for analysis of lists and is not optimized, checks are counted in rule hit counters like any others
+func (d *Dnsfilter) Coverage(hosts []string) CoverageReport {
+	report := CoverageReport{ByReason: map[Reason]int{}}
+	hits := map[uint64]*RuleCoverage{}
+	for _, host := range hosts {
+		report.Total++
+		res, err := d.CheckHost(host)
+		if err != nil {
+			report.Errors++
+			continue
+		}
+		if !res.IsFiltered {
+			continue
+		}
+		report.Blocked++
+		report.ByReason[res.Reason]++
+		if res.RuleID == 0 {
+			continue
+		}
+		rc, ok := hits[res.RuleID]
+		if !ok {
+			rc = &RuleCoverage{ID: res.RuleID, Text: res.Rule}
+			hits[res.RuleID] = rc
+		}
+		rc.Hits++
+	}
+
+	for _, rc := range hits {
+		report.TopRules = append(report.TopRules, *rc)
+	}
+	sort.Slice(report.TopRules, func(i, j int) bool {
+		a, b := report.TopRules[i], report.TopRules[j]
+		if a.Hits != b.Hits {
+			return a.Hits > b.Hits
+		}
+		return a.ID < b.ID
+	})
+	if len(report.TopRules) > coverageTopRules {
+		report.TopRules = report.TopRules[:coverageTopRules]
+	}
+	return report
+}
@@ -3,14 +3,19 @@ package dnsfilter
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -18,7 +23,10 @@ import (
 
 	_ "github.com/benburkert/dns/init"
 	"github.com/bluele/gcache"
+	"golang.org/x/net/idna"
 	"golang.org/x/net/publicsuffix"
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/time/rate"
 )
 
 const defaultCacheSize = 64 * 1024 // in number of elements
@@ -29,27 +37,115 @@ const defaultHTTPMaxIdleConnections = 100
 
 const defaultSafebrowsingServer = "sb.adtidy.org"
 const defaultSafebrowsingURL = "http://%s/safebrowsing-lookup-hash.html?prefixes=%s"
+const defaultSafebrowsingJSONURL = "http://%s/safebrowsing-lookup-hash.json?prefixes=%s"
 const defaultParentalServer = "pctrl.adguard.com"
 const defaultParentalURL = "http://%s/check-parental-control-hash?prefixes=%s&sensitivity=%d"
+const defaultHashPrefixLen = 4 // in bytes of SHA-256 hash sent to safebrowsing and parental servers
+const defaultUserAgent = "AdguardDNS/filter"
 
 // ErrInvalidSyntax is returned by AddRule when rule is invalid
 var ErrInvalidSyntax = errors.New("dnsfilter: invalid rule syntax")
 
+// errRuleExists is returned by addRule for rules that were already added, AddRule reports them as ErrInvalidSyntax
+var errRuleExists = errors.New("dnsfilter: rule already exists")
+
+// invalidRegexpError is returned by addRule for rules with regexps that don't compile, AddRule reports them as ErrInvalidSyntax
+type invalidRegexpError struct {
+	err error
+}
+
+func (e *invalidRegexpError) Error() string {
+	return "dnsfilter: invalid regexp: " + e.err.Error()
+}
+
+// publicError converts errors of addRule to errors returned by AddRule
+func publicError(err error) error {
+	switch err.(type) {
+	case *invalidRegexpError, *skippedRuleError:
+		return ErrInvalidSyntax
+	}
+	if err == errRuleExists {
+		return ErrInvalidSyntax
+	}
+	return err
+}
+
+// ErrUnknownModifier is returned by AddRule when rule has a modifier that is neither supported, nor accepted or ignored, and SetStrictModifiers is on
+// it's returned regardless of SetStrictModifiers for unsupported modifiers that narrow down the queries rule applies to, like $dnstype
+// see SetAcceptedModifiers and SetIgnoredModifiers
+var ErrUnknownModifier = errors.New("dnsfilter: unknown rule modifier")
+
+// ErrInvalidSeparatorClass is returned by SetSeparatorClass when separator is not a regexp character class
+var ErrInvalidSeparatorClass = errors.New("dnsfilter: invalid separator, must be a regexp character class")
+
 // ErrInvalidParental is returned by EnableParental when sensitivity is not a valid value
 var ErrInvalidParental = errors.New("dnsfilter: invalid parental sensitivity, must be either 3, 10, 13 or 17")
 
+// ErrInvalidDNSRewrite is returned by AddRule when rule has $dnsrewrite option with unsupported value
+var ErrInvalidDNSRewrite = errors.New("dnsfilter: invalid $dnsrewrite value, must be either NXDOMAIN, REFUSED, NODATA or an IP address")
+
+// ErrInvalidHost is returned by CheckHost when hostname contains characters that are not allowed in domain names
+var ErrInvalidHost = errors.New("dnsfilter: invalid hostname")
+
+// ErrRateLimited is returned by safebrowsing lookup that couldn't be done within HTTP timeout because of SetSafeBrowsingRateLimit
+var ErrRateLimited = errors.New("dnsfilter: safebrowsing rate limit exceeded")
+
+// ErrRegexRulesDisabled is returned by AddRule when rule needs regexp matching, but it was disabled with SetAllowRegexRules
+var ErrRegexRulesDisabled = errors.New("dnsfilter: regex and mask rules are disabled")
+
+// ErrInvalidLabels is returned by AddRule when rule has $labels option with a value that is not a non-negative integer
+var ErrInvalidLabels = errors.New("dnsfilter: invalid $labels value, must be a non-negative integer")
+
+// ErrRuleLimitExceeded is returned by AddRule when number of rules has reached the limit set by SetMaxRules
+var ErrRuleLimitExceeded = errors.New("dnsfilter: rule limit exceeded")
+
 const shortcutLength = 6 // used for rule search optimization, 6 hits the sweet spot
 
 const enableFastLookup = true         // flag for debugging, must be true in production for faster performance
 const enableDelayedCompilation = true // flag for debugging, must be true in production for faster performance
 
 type config struct {
-	parentalServer      string
-	parentalSensitivity int // must be either 3, 10, 13 or 17
-	parentalEnabled     bool
-	safeSearchEnabled   bool
-	safeBrowsingEnabled bool
-	safeBrowsingServer  string
+	parentalServer     string
+	safeBrowsingServer string
+	safeBrowsingPrefix int // length of hash prefixes in bytes
+	safeBrowsingProto  SafeBrowsingProtocol
+	safeBrowsingDepth  int  // number of parent domains checked by safebrowsing, all if zero
+	regexRulesDisabled bool // only rules that can be matched by domain suffix are allowed
+	regexFullMatch     bool // /regex/ rules are anchored to match entire hostname
+	strictModifiers    bool // rules with modifiers that can't be applied to DNS are rejected
+
+	safeBrowsingExempt []*net.IPNet    // clients that are never checked by safebrowsing, see SetSafeBrowsingExemptClients
+	blockedTLDs        map[string]bool // hosts under these public suffixes are blocked unless whitelisted, see SetBlockedTLDs
+
+	filterPriority map[uint32]int // filter list ID -> its position in SetFilterPriority
+	maxRules       int            // AddRule fails when there are that many rules, unlimited if zero, see SetMaxRules
+
+	resultCacheSize int // number of cached rule matches, no cache if zero, see SetResultCache
+
+	safeSearchMapping map[string]string // overrides of safeSearchDomains, never modified, only replaced, see SetSafeSearchMapping
+
+	blockingIPv4 net.IP // answer for blocked A queries, see SetBlockingIP
+	blockingIPv6 net.IP // answer for blocked AAAA queries, see SetBlockingIP
+
+	userAgent string // sent with safebrowsing and parental lookups
+
+	strictHostValidation bool // hostnames must conform to RFC 1035, see SetStrictHostValidation
+	monitorMode          bool // filtering verdicts are only counted and reported to match hook, see SetMonitorMode
+
+	enforcedReasons ReasonMask // reasons that set Result.IsFiltered, all if zero, see SetEnforcedReasons
+
+	idnaNormalization bool // hostnames and rules are converted to punycode, see SetIDNANormalization
+
+	separatorClass string // regexp character class that ^ matches besides end of hostname, see SetSeparatorClass
+	keywordRules   bool   // rules without anchors and wildcards match whole labels, see SetKeywordRules
+
+	publicSuffixWildcards bool // ||example.*^ matches example followed by a public suffix, see SetPublicSuffixWildcards
+
+	fetchAttempts int           // number of LoadFilterURL download attempts, single attempt if zero
+	fetchBackoff  time.Duration // wait before the first retry of LoadFilterURL download, doubled for each next one
+
+	acceptedModifiers map[string]bool // modifiers that are dropped from rules, see SetAcceptedModifiers
+	ignoredModifiers  map[string]bool // modifiers that can't be applied to DNS filtering, browserOnlyOptions if nil, see SetIgnoredModifiers
 }
 
 type rule struct {
@@ -58,15 +154,40 @@ type rule struct {
 	originalText string // original text for reporting back to applications
 
 	// options
-	options []string // optional options after $
+	options        []string // optional options after $
+	ignoredOptions []string // options that make sense only in browsers
+	unknownOptions []string // options that are not known at all, they are dropped unless SetStrictModifiers is on
 
 	// parsed options
 	apps        []string
+	classes     []uint16     // DNS query classes this rule is restricted to, any class if empty
+	clients     []*net.IPNet // client subnets this rule is restricted to, any client if empty
+	protocols   []string     // protocols this rule is restricted to, any protocol if empty
+	domains     []string     // queried host must be one of these domains or their subdomains, any host if empty
+	excluded    []string     // queried host must not be one of these domains or their subdomains, set by $domain=~ and $denyallow
+	minLabels   int          // for $maxlabels=N, host must have more than N labels before the rule's domain
+	labels      int          // for $labels=N, host must have exactly N labels before the rule's domain, see hasLabels
+	hasLabels   bool
+	matchAll    bool   // rule is * or ||*^, it matches any host without regexp
+	keyword     string // lowercased rule text that has to be a whole label of the host, see SetKeywordRules
+	tldWildcard string // lowercased example of ||example.*^, see SetPublicSuffixWildcards
+	rewrite     *DNSRewrite
 	isWhitelist bool
 	isImportant bool
+	isFullMatch bool // /regex/ has to match entire hostname, see SetRegexFullMatch
+
+	separatorClass string // what ^ matches besides end of hostname, see SetSeparatorClass
+
+	badfilter string // for $badfilter rules, text of the rule they disable, such rules aren't matched themselves
 
 	// user-supplied data
-	listID uint32
+	listID  uint32
+	comment string
+
+	id          uint64 // unique within Dnsfilter instance, assigned when rule is added
+	disabled    uint32 // set atomically, disabled rules are skipped during matching
+	badfiltered uint32 // set atomically, like disabled, but by a $badfilter rule
+	hits        uint64 // incremented atomically each time rule decides the result of CheckHost
 
 	// suffix matching
 	isSuffix bool
@@ -75,10 +196,28 @@ type rule struct {
 	// compiled regexp
 	compiled *regexp.Regexp
 
+	// network matching for CheckIP, rule is not used for hostnames if set
+	network *net.IPNet
+
 	sync.RWMutex
 }
 
+// RuleInfo describes a rule that was added to Dnsfilter
+type RuleInfo struct {
+	ID           uint64 // as returned by AddRuleID
+	FilterListID uint32
+	Text         string // original text of the rule
+	IsWhitelist  bool
+	IsImportant  bool
+	IsRegexp     bool // rule can't be matched by domain suffix and needs regexp matching
+	Enabled      bool
+	Comment      string // as passed to AddRuleWithComment
+	Hits         uint64 // number of checks decided by the rule, see RuleHits
+	Pattern      string // regexp the rule is matched with, empty unless IsRegexp, e.g. for support of mask rules
+}
+
 // LookupStats store stats collected during safebrowsing or parental checks
+// counters are updated atomically, use StatsSnapshot to read them
 type LookupStats struct {
 	Requests   uint64 // number of HTTP requests that were sent
 	CacheHits  uint64 // number of lookups that didn't need HTTP requests
@@ -95,18 +234,115 @@ type Stats struct {
 // Dnsfilter holds added rules and performs hostname matches against the rules
 type Dnsfilter struct {
 	storage      map[string]*rule // rule storage, not used for matching, needs to be key->value
+	rulesByID    map[uint64]*rule // same rules as in storage, but keyed by rule ID
+	filterCounts map[uint32]int   // number of rules in storage by filter list ID
+	badfilters   map[string]int   // text of rules disabled by $badfilter rules -> number of such $badfilter rules
 	storageMutex sync.RWMutex
+	lastRuleID   uint64 // incremented atomically for each new rule
+
+	resultCache     gcache.Cache // results of matching rules, nil if disabled, see SetResultCache
+	rulesGeneration uint64       // incremented atomically on each change of rules, so that cached results become stale
 
 	// rules are checked against these lists in the order defined here
-	important *rulesTable // more important than whitelist and is checked first
-	whiteList *rulesTable // more important than blacklist
-	blackList *rulesTable
+	importantWhiteList *rulesTable // whitelist rules with $important, they are checked first
+	important          *rulesTable // more important than whitelist
+	whiteList          *rulesTable // more important than blacklist
+	blackList          *rulesTable
+
+	// number and total pattern length of rules that need regexp matching, updated atomically
+	regexCount int64
+	regexBytes int64
+
+	// number of whitelist and other rules, updated atomically
+	whitelistCount int64
+	blacklistCount int64
+	badfilterCount int64
+
+	wouldBlock uint64 // number of checks that were not filtered because of monitor mode, updated atomically
+
+	filteringDisabled uint32 // all checks are skipped if not zero, updated atomically, see SetEnabled
+
+	// features toggled with Enable and Disable methods, not zero if enabled, updated atomically so that they can be toggled while checks are running
+	safeBrowsingEnabled uint32
+	parentalEnabled     uint32
+	safeSearchEnabled   uint32
+	parentalSensitivity int32 // must be either 3, 10, 13 or 17
+
+	reasonCounts [numReasons]uint64 // number of checks by reason of their results, updated atomically, see PublishExpvar
 
 	// HTTP lookups for safebrowsing and parental
 	client    http.Client     // handle for http client -- single instance as recommended by docs
 	transport *http.Transport // handle for http transport used by http client
 
+	customClient *http.Client // used instead of client if set, see SetHTTPClient
+
+	parentalTransport http.RoundTripper // used for parental lookups instead of transport if set, see SetParentalTransport
+
+	lookupGroup       singleflight.Group // coalesces concurrent safebrowsing and parental HTTP lookups with the same URL
+	lookupCtx         context.Context    // HTTP lookups are done with it, so that Destroy can abort them
+	cancelLookups     context.CancelFunc // cancels lookupCtx
+	destroyed         uint32             // HTTP lookups are not done after Destroy if not zero, updated atomically
+	safeBrowsingLimit *rate.Limiter      // limits safebrowsing HTTP requests if set, see SetSafeBrowsingRateLimit
+
 	config config
+
+	matchHook func(MatchEvent) // called after each decision made by CheckHost
+
+	skipLog func(lineNo int, rule, reason string) // called by LoadRules for each line that is not added, see SetSkipLog
+
+	fastPass      map[string]bool // hostnames that are never filtered, see LoadFastPassDomains
+	fastPassMutex sync.RWMutex
+
+	filterMeta      map[uint32]FilterMeta // metadata of filter lists loaded by LoadRules
+	filterMetaMutex sync.Mutex
+
+	skipped      []SkippedRule // rules that were skipped by AddRule for reasons other than syntax
+	skippedMutex sync.Mutex
+
+	// resolving of safesearch replacement hosts
+	resolve         func(ctx context.Context, host string) ([]net.IP, error)
+	safeSearchCache safeSearchCache
+}
+
+// SkippedRule describes a rule that AddRule didn't add even though its syntax is valid
+type SkippedRule struct {
+	Text   string
+	Reason string
+	Line   int // line number in the list passed to LoadRules, zero for rules added otherwise
+}
+
+// MatchEvent describes a decision made by CheckHost, it is passed to a function set by SetMatchHook
+type MatchEvent struct {
+	Host   string // normalized hostname that was checked
+	Result Result
+	Rule   string // matched rule, if any
+	Time   time.Time
+	Meta   QueryMeta // details of the query, zero for CheckHost
+}
+
+// QueryMeta holds details of DNS query that rules can be restricted to and that are reported to the match hook, see CheckHostMeta
+type QueryMeta struct {
+	QType        uint16     // DNS query type, e.g. 1 for A
+	QClass       uint16     // DNS query class, IN if zero
+	ClientIP     net.IP     // address of the client
+	ClientSubnet *net.IPNet // EDNS Client Subnet, see CheckHostForClient
+	Protocol     string     // protocol the query came over, one of Protocol constants, for rules with $protocol option
+}
+
+// protocols that queries can come over, see QueryMeta.Protocol
+const (
+	ProtocolUDP = "udp"
+	ProtocolTCP = "tcp"
+	ProtocolDoT = "dot" // DNS-over-TLS
+	ProtocolDoH = "doh" // DNS-over-HTTPS
+)
+
+// protocols that can be used in $protocol option
+var knownProtocols = map[string]bool{
+	ProtocolUDP: true,
+	ProtocolTCP: true,
+	ProtocolDoT: true,
+	ProtocolDoH: true,
 }
 
 //go:generate stringer -type=Reason
@@ -128,18 +364,138 @@ const (
 	FilteredSafeSearch   // the host was replaced with safesearch variant
 )
 
+// ReasonMask is a set of filtering reasons, see SetEnforcedReasons
+type ReasonMask uint32
+
+// MaskOf returns a set of specified reasons
+func MaskOf(reasons ...Reason) ReasonMask {
+	var mask ReasonMask
+	for _, r := range reasons {
+		mask |= 1 << uint(r)
+	}
+	return mask
+}
+
+// Has tells if reason is in the set
+func (m ReasonMask) Has(r Reason) bool {
+	return m&(1<<uint(r)) != 0
+}
+
 // these variables need to survive coredns reload
 var (
-	stats             Stats
+	stats Stats
+
+	// caches are created on first use and replaced by SetCacheEvictionPolicy, see lookupCaches
 	safebrowsingCache gcache.Cache
 	parentalCache     gcache.Cache
+	lookupCachesOnce  sync.Once
+	lookupCachesMutex sync.RWMutex // protects the caches and cacheEvictionPolicy
 )
 
+// CacheEvictionPolicy defines which entries are evicted from full safebrowsing and parental caches
+type CacheEvictionPolicy int
+
+const (
+	CacheEvictionLRU CacheEvictionPolicy = iota // least recently used entries are evicted, default
+	CacheEvictionLFU                            // least frequently used entries are evicted, so hot entries survive floods of one-off lookups
+)
+
+var cacheEvictionPolicy = CacheEvictionLRU
+
+// SetCacheEvictionPolicy changes eviction policy of safebrowsing and parental caches
+// caches are shared between all Dnsfilter instances and are purged when policy is changed, it's safe to call while checks are running
+func SetCacheEvictionPolicy(policy CacheEvictionPolicy) {
+	// caches created here must not be replaced by lazy creation in lookupCaches
+	lookupCachesOnce.Do(func() {})
+	lookupCachesMutex.Lock()
+	defer lookupCachesMutex.Unlock()
+	cacheEvictionPolicy = policy
+	safebrowsingCache = newLookupCache(policy, defaultCacheSize)
+	parentalCache = newLookupCache(policy, defaultCacheSize)
+}
+
+// lookupCaches returns current safebrowsing and parental caches, creating them on first use
+func lookupCaches() (safebrowsing, parental gcache.Cache) {
+	lookupCachesOnce.Do(func() {
+		lookupCachesMutex.Lock()
+		safebrowsingCache = newLookupCache(cacheEvictionPolicy, defaultCacheSize)
+		parentalCache = newLookupCache(cacheEvictionPolicy, defaultCacheSize)
+		lookupCachesMutex.Unlock()
+	})
+	lookupCachesMutex.RLock()
+	defer lookupCachesMutex.RUnlock()
+	return safebrowsingCache, parentalCache
+}
+
+func newLookupCache(policy CacheEvictionPolicy, size int) gcache.Cache {
+	builder := gcache.New(size).Expiration(defaultCacheTime)
+	switch policy {
+	case CacheEvictionLFU:
+		builder = builder.LFU()
+	default:
+		builder = builder.LRU()
+	}
+	return builder.Build()
+}
+
 // Result holds state of hostname check
 type Result struct {
 	IsFiltered bool   `json:",omitempty"`
 	Reason     Reason `json:",omitempty"`
 	Rule       string `json:",omitempty"`
+	RuleID     uint64 `json:",omitempty"` // ID of matched rule, as returned by AddRuleID
+	FilterID   uint32 `json:",omitempty"` // filter list ID of matched rule
+	Comment    string `json:",omitempty"` // comment of matched rule, as passed to AddRuleWithComment
+	Category   string `json:",omitempty"` // category reported by parental control server, e.g. PORN, set for FilteredParental
+
+	DNSRewrite *DNSRewrite `json:",omitempty"` // response that DNS server should return, set by rules with $dnsrewrite option
+	ThreatType ThreatType  `json:",omitempty"` // kind of threat, set for FilteredSafeBrowsing
+
+	BlockedResponse *BlockedResponse `json:",omitempty"` // addresses to answer blocked queries with, nil means NXDOMAIN, see SetBlockingIP
+}
+
+// BlockedResponse holds addresses that DNS server should answer with instead of the real ones for blocked hosts
+// nil address means NXDOMAIN for queries of that type
+type BlockedResponse struct {
+	IPv4 net.IP `json:",omitempty"`
+	IPv6 net.IP `json:",omitempty"`
+}
+
+// ThreatType tells what kind of threat safebrowsing has found
+type ThreatType string
+
+// safebrowsing threat types
+const (
+	ThreatMalware  ThreatType = "malware"
+	ThreatPhishing ThreatType = "phishing"
+	ThreatUnwanted ThreatType = "unwanted"
+	ThreatUnknown  ThreatType = "unknown" // safebrowsing list name isn't recognized
+)
+
+// threatTypeFromList returns threat type by name of safebrowsing list, e.g. adguard-malware-shavar
+func threatTypeFromList(list string) ThreatType {
+	switch {
+	case strings.Contains(list, "malware"):
+		return ThreatMalware
+	case strings.Contains(list, "phish"):
+		return ThreatPhishing
+	case strings.Contains(list, "unwanted"):
+		return ThreatUnwanted
+	}
+	return ThreatUnknown
+}
+
+// DNSRewrite holds DNS response that should be returned instead of resolving the query
+type DNSRewrite struct {
+	RCode int      // DNS response code, NODATA is NOERROR with empty answer
+	IPs   []net.IP `json:",omitempty"` // addresses to answer with, set by rules like $dnsrewrite=1.2.3.4
+}
+
+// response codes that can be used in $dnsrewrite option
+var dnsRewriteRCodes = map[string]int{
+	"NODATA":   0,
+	"NXDOMAIN": 3,
+	"REFUSED":  5,
 }
 
 // Matched can be used to see if any match at all was found, no matter filtered or not
@@ -147,16 +503,159 @@ func (r Reason) Matched() bool {
 	return r != NotFilteredNotFound
 }
 
+// MarshalJSON encodes reason as its name, e.g. "FilteredBlackList"
+func (r Reason) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
+// UnmarshalJSON decodes reason from its name, or from a number as it was encoded before reasons had names in JSON
+func (r *Reason) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		var number int
+		if json.Unmarshal(data, &number) != nil {
+			return err
+		}
+		*r = Reason(number)
+		return nil
+	}
+	for i := 0; i < len(_Reason_index)-1; i++ {
+		if Reason(i).String() == name {
+			*r = Reason(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("dnsfilter: unknown reason %q", name)
+}
+
 // CheckHost tries to match host against rules, then safebrowsing and parental if they are enabled
+// empty hostname or "." is not filtered, hostname with characters not allowed in domain names is not filtered and ErrInvalidHost is returned
 func (d *Dnsfilter) CheckHost(host string) (Result, error) {
+	return d.check(query{host: host, qclass: classINET})
+}
+
+// CheckHostClass is like CheckHost, but also takes DNS query class into account for rules with $dnsclass option
+func (d *Dnsfilter) CheckHostClass(host string, qclass uint16) (Result, error) {
+	return d.CheckHostMeta(host, QueryMeta{QClass: qclass})
+}
+
+// CheckHostType is like CheckHost, but also reports DNS query type to the match hook
+func (d *Dnsfilter) CheckHostType(host string, qtype uint16) (Result, error) {
+	return d.CheckHostMeta(host, QueryMeta{QType: qtype})
+}
+
+// CheckHostMeta is like CheckHost, but takes all known details of the query into account and reports them to the match hook
+func (d *Dnsfilter) CheckHostMeta(host string, meta QueryMeta) (Result, error) {
+	q := query{host: host, qclass: meta.QClass, clientIP: meta.ClientIP, clientSubnet: meta.ClientSubnet, protocol: strings.ToLower(meta.Protocol), meta: meta}
+	if q.qclass == 0 {
+		q.qclass = classINET
+	}
+	return d.check(q)
+}
+
+// CheckHostForClient is like CheckHost, but also takes client address into account for rules with $client option
+// if ecs is not nil, it's the EDNS Client Subnet sent by a forwarding resolver, and it takes precedence over clientIP, which is then the address of that resolver
+// otherwise rules are matched against explicit clientIP, and rules with $client never match if both are nil
+func (d *Dnsfilter) CheckHostForClient(host string, clientIP net.IP, ecs *net.IPNet) (Result, error) {
+	return d.CheckHostMeta(host, QueryMeta{ClientIP: clientIP, ClientSubnet: ecs})
+}
+
+// CheckHostStream checks hosts one by one in the given order, like DNS server does for a stream of queries
+// results are in the same order as hosts, checks that failed have NotFilteredError reason
+// it's meant for benchmarking with real traffic: capture queried hostnames from the query log, one per line and repeated as often as they were queried,
+// then run BenchmarkCheckHostStream with DNSFILTER_QUERY_TRACE set to that file, so that caches and rules are exercised as in production
+func (d *Dnsfilter) CheckHostStream(hosts []string) []Result {
+	results := make([]Result, len(hosts))
+	for i, host := range hosts {
+		result, err := d.CheckHost(host)
+		if err != nil {
+			result = Result{Reason: NotFilteredError}
+		}
+		results[i] = result
+	}
+	return results
+}
+
+// check normalizes queried hostname and does the checks for it
+func (d *Dnsfilter) check(q query) (Result, error) {
+	if d.isFilteringDisabled() {
+		return Result{Reason: NotFilteredNotFound}, nil
+	}
+	if d.config.strictHostValidation {
+		if _, stripped := stripSchemeAndPort(strings.TrimSpace(q.host)); stripped {
+			return Result{Reason: NotFilteredNotFound}, ErrInvalidHost
+		}
+	}
+	q.host = normalizeHost(q.host)
 	// sometimes DNS clients will try to resolve ".", which is a request to get root servers
-	if host == "" {
+	if q.host == "" || d.isFastPass(q.host) {
+		return Result{Reason: NotFilteredNotFound}, nil
+	}
+	if d.config.idnaNormalization {
+		host, err := idna.ToASCII(q.host)
+		if err != nil {
+			return Result{Reason: NotFilteredNotFound}, ErrInvalidHost
+		}
+		q.host = host
+		if strings.Contains(host, "xn--") {
+			q.unicodeHost, _ = idna.ToUnicode(host)
+		}
+	}
+	if !isValidHost(q.host) || (d.config.strictHostValidation && !isStrictHost(q.host)) {
+		return Result{Reason: NotFilteredNotFound}, ErrInvalidHost
+	}
+
+	result, err := d.checkHost(q)
+	if err == nil && result.IsFiltered && d.config.enforcedReasons != 0 && !d.config.enforcedReasons.Has(result.Reason) {
+		// advisory reason, it's reported but the host isn't filtered
+		result.IsFiltered = false
+	}
+	if err == nil && result.IsFiltered {
+		result.BlockedResponse = d.blockedResponse(result)
+	}
+	if err == nil && result.RuleID != 0 {
+		d.countHit(result.RuleID)
+	}
+	if err == nil {
+		d.countReason(result.Reason)
+	}
+	if err == nil && d.matchHook != nil {
+		d.matchHook(MatchEvent{
+			Host:   q.host,
+			Result: result,
+			Rule:   result.Rule,
+			Time:   time.Now(),
+			Meta:   q.meta,
+		})
+	}
+	if err == nil && d.config.monitorMode && result.IsFiltered {
+		atomic.AddUint64(&d.wouldBlock, 1)
 		return Result{Reason: NotFilteredNotFound}, nil
 	}
-	host = strings.ToLower(host)
+	return result, err
+}
+
+// blockedResponse returns configured blocking addresses if result blocks the host without $dnsrewrite
+func (d *Dnsfilter) blockedResponse(result Result) *BlockedResponse {
+	if d.config.blockingIPv4 == nil && d.config.blockingIPv6 == nil {
+		return nil
+	}
+	if result.DNSRewrite != nil {
+		return nil
+	}
+	switch result.Reason {
+	case FilteredBlackList, FilteredSafeBrowsing, FilteredParental:
+		return &BlockedResponse{IPv4: d.config.blockingIPv4, IPv6: d.config.blockingIPv6}
+	}
+	return nil
+}
+
+// checkHost does the checks for CheckHostClass with already normalized hostname
+func (d *Dnsfilter) checkHost(q query) (Result, error) {
+	host := q.host
 
 	// try filter lists first
-	result, err := d.matchHost(host)
+	result, err := d.matchHostCached(q)
 	if err != nil {
 		return result, err
 	}
@@ -164,9 +663,14 @@ func (d *Dnsfilter) CheckHost(host string) (Result, error) {
 		return result, nil
 	}
 
+	// block hosts under blocked TLDs that no whitelist rule has matched
+	if tld, ok := blockedTLD(host, d.config.blockedTLDs); ok {
+		return Result{IsFiltered: true, Reason: FilteredBlackList, Rule: "*." + tld}, nil
+	}
+
 	// check safebrowsing if no match
-	if d.config.safeBrowsingEnabled {
-		result, err = d.checkSafeBrowsing(host)
+	if isFlagSet(&d.safeBrowsingEnabled) && !matchClientNetworks(q, d.config.safeBrowsingExempt) {
+		result, err = d.checkSafeBrowsing(context.Background(), host)
 		if err != nil {
 			// failed to do HTTP lookup -- treat it as if we got empty response, but don't save cache
 			log.Printf("Failed to do safebrowsing HTTP lookup, ignoring check: %v", err)
@@ -178,8 +682,8 @@ func (d *Dnsfilter) CheckHost(host string) (Result, error) {
 	}
 
 	// check parental if no match
-	if d.config.parentalEnabled {
-		result, err = d.checkParental(host)
+	if isFlagSet(&d.parentalEnabled) {
+		result, err = d.checkParental(context.Background(), host)
 		if err != nil {
 			// failed to do HTTP lookup -- treat it as if we got empty response, but don't save cache
 			log.Printf("Failed to do parental HTTP lookup, ignoring check: %v", err)
@@ -194,6 +698,26 @@ func (d *Dnsfilter) CheckHost(host string) (Result, error) {
 	return Result{}, nil
 }
 
+// query holds hostname that is being checked along with DNS query details that rules can be restricted to
+type query struct {
+	host         string
+	qclass       uint16
+	clientIP     net.IP     // address of the client, if known
+	clientSubnet *net.IPNet // EDNS Client Subnet, if present
+	protocol     string     // lowercased protocol the query came over, if known
+	meta         QueryMeta  // as passed by caller, for the match hook
+	unicodeHost  string     // host with punycode labels decoded, set only with IDNA normalization, for regex rules
+}
+
+// DNS query classes that can be used in $dnsclass option
+const classINET uint16 = 1
+
+var dnsClasses = map[string]uint16{
+	"IN": classINET,
+	"CH": 3,
+	"HS": 4,
+}
+
 //
 // rules table
 //
@@ -201,6 +725,8 @@ func (d *Dnsfilter) CheckHost(host string) (Result, error) {
 type rulesTable struct {
 	rulesByShortcut map[string][]*rule
 	rulesLeftovers  []*rule
+	rulesByNetwork  []*rule // rules for CheckIP
+	rulesMatchAll   []*rule // rules that match any host, they are checked after all others
 	sync.RWMutex
 }
 
@@ -213,7 +739,11 @@ func newRulesTable() *rulesTable {
 
 func (r *rulesTable) Add(rule *rule) {
 	r.Lock()
-	if len(rule.shortcut) == shortcutLength && enableFastLookup {
+	if rule.network != nil {
+		r.rulesByNetwork = append(r.rulesByNetwork, rule)
+	} else if rule.matchAll {
+		r.rulesMatchAll = append(r.rulesMatchAll, rule)
+	} else if len(rule.shortcut) == shortcutLength && enableFastLookup {
 		r.rulesByShortcut[rule.shortcut] = append(r.rulesByShortcut[rule.shortcut], rule)
 	} else {
 		r.rulesLeftovers = append(r.rulesLeftovers, rule)
@@ -221,27 +751,93 @@ func (r *rulesTable) Add(rule *rule) {
 	r.Unlock()
 }
 
-func (r *rulesTable) matchByHost(host string) (Result, error) {
-	res, err := r.searchShortcuts(host)
-	if err != nil {
-		return res, err
+func (r *rulesTable) Remove(rule *rule) {
+	r.Lock()
+	if rule.network != nil {
+		r.rulesByNetwork = removeRuleFromSlice(r.rulesByNetwork, rule)
+	} else if rule.matchAll {
+		r.rulesMatchAll = removeRuleFromSlice(r.rulesMatchAll, rule)
+	} else if len(rule.shortcut) == shortcutLength && enableFastLookup {
+		rules := removeRuleFromSlice(r.rulesByShortcut[rule.shortcut], rule)
+		if len(rules) == 0 {
+			delete(r.rulesByShortcut, rule.shortcut)
+		} else {
+			r.rulesByShortcut[rule.shortcut] = rules
+		}
+	} else {
+		r.rulesLeftovers = removeRuleFromSlice(r.rulesLeftovers, rule)
 	}
-	if res.Reason.Matched() {
-		return res, nil
+	r.Unlock()
+}
+
+func removeRuleFromSlice(rules []*rule, rule *rule) []*rule {
+	for i := range rules {
+		if rules[i] == rule {
+			rules = append(rules[:i], rules[i+1:]...)
+			// don't keep removed rule alive through the unused part of the array
+			rules[:len(rules)+1][len(rules)] = nil
+			return rules
+		}
 	}
+	return rules
+}
+
+// compact reallocates rules table without the spare capacity left by removed rules
+func (r *rulesTable) compact() {
+	r.Lock()
+	defer r.Unlock()
+	byShortcut := make(map[string][]*rule, len(r.rulesByShortcut))
+	for shortcut, rules := range r.rulesByShortcut {
+		byShortcut[shortcut] = append([]*rule(nil), rules...)
+	}
+	r.rulesByShortcut = byShortcut
+	r.rulesLeftovers = append(make([]*rule, 0, len(r.rulesLeftovers)), r.rulesLeftovers...)
+	r.rulesByNetwork = append([]*rule(nil), r.rulesByNetwork...)
+	r.rulesMatchAll = append([]*rule(nil), r.rulesMatchAll...)
+}
 
-	res, err = r.searchLeftovers(host)
+func (r *rulesTable) matchByHost(q query, skipRegex bool) (Result, error) {
+	r.RLock()
+	defer r.RUnlock()
+	res := Result{}
+	var err error
+	r.walk(q.host, skipRegex, func(rule *rule) bool {
+		res, err = rule.match(q)
+		// stop search on error or match, continue otherwise
+		return err != nil || res.Reason.Matched()
+	})
 	if err != nil {
 		return res, err
 	}
 	if res.Reason.Matched() {
 		return res, nil
 	}
-
 	return Result{}, nil
 }
 
-func (r *rulesTable) searchShortcuts(host string) (Result, error) {
+// matchAllByHost is like matchByHost, but returns all rules that match instead of the first one
+func (r *rulesTable) matchAllByHost(q query, skipRegex bool) ([]*rule, error) {
+	r.RLock()
+	defer r.RUnlock()
+	matched := []*rule{}
+	var err error
+	r.walk(q.host, skipRegex, func(rule *rule) bool {
+		var res Result
+		res, err = rule.match(q)
+		if err != nil {
+			return true
+		}
+		if res.Reason.Matched() {
+			matched = append(matched, rule)
+		}
+		return false
+	})
+	return matched, err
+}
+
+// walk calls fn for rules that might match host until fn returns true, caller must hold the lock
+// rules with shortcuts found in host are visited first, then the leftovers
+func (r *rulesTable) walk(host string, skipRegex bool, fn func(rule *rule) bool) {
 	// check in shortcuts first
 	for i := 0; i < len(host); i++ {
 		shortcut := host[i:]
@@ -256,35 +852,29 @@ func (r *rulesTable) searchShortcuts(host string) (Result, error) {
 			continue
 		}
 		for _, rule := range rules {
-			res, err := rule.match(host)
-			// error? stop search
-			if err != nil {
-				return res, err
+			if skipRegex && rule.needsRegexp() {
+				continue
 			}
-			// matched? stop search
-			if res.Reason.Matched() {
-				return res, err
+			if fn(rule) {
+				return
 			}
-			// continue otherwise
 		}
 	}
-	return Result{}, nil
-}
 
-func (r *rulesTable) searchLeftovers(host string) (Result, error) {
 	for _, rule := range r.rulesLeftovers {
-		res, err := rule.match(host)
-		// error? stop search
-		if err != nil {
-			return res, err
+		if skipRegex && rule.needsRegexp() {
+			continue
 		}
-		// matched? stop search
-		if res.Reason.Matched() {
-			return res, err
+		if fn(rule) {
+			return
+		}
+	}
+
+	for _, rule := range r.rulesMatchAll {
+		if fn(rule) {
+			return
 		}
-		// continue otherwise
 	}
-	return Result{}, nil
 }
 
 func findOptionIndex(text string) int {
@@ -319,7 +909,11 @@ func (rule *rule) extractOptions() error {
 	}
 
 	optionsStr := rule.text[optIndex:]
-	rule.text = rule.text[:optIndex-1] // remove options from text
+	rule.text = strings.TrimSpace(rule.text[:optIndex-1]) // remove options from text
+	if strings.Trim(rule.text, "|") == "" {
+		// nothing to match besides anchors, options can't be checked against it
+		return ErrInvalidSyntax
+	}
 
 	begin := 0
 	i := 0
@@ -332,19 +926,21 @@ func (rule *rule) extractOptions() error {
 					break // from switch, not for loop
 				}
 			}
-			rule.options = append(rule.options, optionsStr[begin:i])
+			rule.options = append(rule.options, strings.TrimSpace(optionsStr[begin:i]))
 			begin = i + 1
 		}
 	}
 	if begin != i {
 		// there's still an option remaining
-		rule.options = append(rule.options, optionsStr[begin:])
+		rule.options = append(rule.options, strings.TrimSpace(optionsStr[begin:]))
 	}
 
 	return nil
 }
 
-func (rule *rule) parseOptions() error {
+// parseOptions parses options of the rule, modifiers in accepted are dropped as if the rule didn't have them, modifiers in ignored are recorded in ignoredOptions
+// and other unknown modifiers are recorded in unknownOptions
+func (rule *rule) parseOptions(accepted, ignored map[string]bool) error {
 	err := rule.extractOptions()
 	if err != nil {
 		return err
@@ -354,20 +950,176 @@ func (rule *rule) parseOptions() error {
 		switch {
 		case option == "important":
 			rule.isImportant = true
+		case option == "all":
+			// blocks all types of requests, for DNS it's the same as no options
+		case option == "noop" || (option != "" && strings.Trim(option, "_") == ""):
+			// placeholder that list authors use to separate options, e.g. $_,important or $noop
+		case option == "badfilter":
+			rule.badfilter = badfilterTarget(rule.originalText)
+		case strings.HasPrefix(option, "denyallow="):
+			option = strings.TrimPrefix(option, "denyallow=")
+			for _, domain := range strings.Split(strings.ToLower(option), "|") {
+				if domain == "" || strings.HasPrefix(domain, "~") {
+					return ErrInvalidSyntax
+				}
+				rule.excluded = append(rule.excluded, domain)
+			}
 		case strings.HasPrefix(option, "app="):
 			option = strings.TrimPrefix(option, "app=")
 			rule.apps = strings.Split(option, "|")
-		default:
+		case strings.HasPrefix(option, "dnsclass="):
+			option = strings.TrimPrefix(option, "dnsclass=")
+			for _, name := range strings.Split(option, "|") {
+				qclass, ok := dnsClasses[strings.ToUpper(name)]
+				if !ok {
+					return ErrInvalidSyntax
+				}
+				rule.classes = append(rule.classes, qclass)
+			}
+		case strings.HasPrefix(option, "dnsrewrite="):
+			option = strings.TrimPrefix(option, "dnsrewrite=")
+			if rcode, ok := dnsRewriteRCodes[strings.ToUpper(option)]; ok {
+				rule.rewrite = &DNSRewrite{RCode: rcode}
+				break
+			}
+			ip := net.ParseIP(option)
+			if ip == nil {
+				return ErrInvalidDNSRewrite
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			rule.rewrite = &DNSRewrite{IPs: []net.IP{ip}}
+		case strings.HasPrefix(option, "domain="):
+			option = strings.TrimPrefix(option, "domain=")
+			for _, domain := range strings.Split(strings.ToLower(option), "|") {
+				excluded := strings.HasPrefix(domain, "~")
+				domain = strings.TrimPrefix(domain, "~")
+				if domain == "" {
+					return ErrInvalidSyntax
+				}
+				if excluded {
+					rule.excluded = append(rule.excluded, domain)
+				} else {
+					rule.domains = append(rule.domains, domain)
+				}
+			}
+		case strings.HasPrefix(option, "maxlabels="):
+			option = strings.TrimPrefix(option, "maxlabels=")
+			maxLabels, err := strconv.Atoi(option)
+			if err != nil || maxLabels < 0 {
+				return ErrInvalidSyntax
+			}
+			rule.minLabels = maxLabels + 1
+		case strings.HasPrefix(option, "labels="):
+			labels, err := strconv.Atoi(strings.TrimPrefix(option, "labels="))
+			if err != nil || labels < 0 {
+				return ErrInvalidLabels
+			}
+			rule.labels = labels
+			rule.hasLabels = true
+		case strings.HasPrefix(option, "network="):
+			network, err := parseNetwork(strings.TrimPrefix(option, "network="))
+			if err != nil {
+				return err
+			}
+			rule.network = network
+		case strings.HasPrefix(option, "protocol="):
+			option = strings.TrimPrefix(option, "protocol=")
+			for _, name := range strings.Split(strings.ToLower(option), "|") {
+				if !knownProtocols[name] {
+					return ErrInvalidSyntax
+				}
+				rule.protocols = append(rule.protocols, name)
+			}
+		case strings.HasPrefix(option, "client="):
+			option = strings.TrimPrefix(option, "client=")
+			for _, value := range strings.Split(option, "|") {
+				network, err := parseNetwork(value)
+				if err != nil {
+					return err
+				}
+				rule.clients = append(rule.clients, network)
+			}
+		case accepted[optionName(option)]:
+			// operator told us it doesn't restrict the rule for DNS filtering
+		case ignored[optionName(option)]:
+			rule.ignoredOptions = append(rule.ignoredOptions, option)
+		case !isModifierName(optionName(option)):
 			return ErrInvalidSyntax
+		case restrictingOptions[strings.TrimPrefix(optionName(option), "~")]:
+			// dropping it would make the rule block more than it was written for
+			return ErrUnknownModifier
+		default:
+			rule.unknownOptions = append(rule.unknownOptions, option)
 		}
 	}
 
+	// labels can only be counted relative to a domain
+	if (rule.minLabels != 0 || rule.hasLabels) && !rule.isSuffixRule() {
+		return ErrInvalidSyntax
+	}
+	// $network rules are matched against IP addresses only, so they can't have a hostname pattern
+	if rule.network != nil && rule.text != "*" && rule.text != "||*^" {
+		return ErrInvalidSyntax
+	}
+
 	return nil
 }
 
+// browserOnlyOptions have no meaning for DNS filtering, they are ignored unless SetIgnoredModifiers is called
+var browserOnlyOptions = map[string]bool{
+	"popup":        true,
+	"elemhide":     true,
+	"generichide":  true,
+	"genericblock": true,
+	"jsinject":     true,
+	"content":      true,
+	"urlblock":     true,
+	"extension":    true,
+	"stealth":      true,
+	"csp":          true,
+}
+
+// restrictingOptions are unsupported modifiers that restrict which queries rule applies to, rules with them are rejected unless SetAcceptedModifiers is called
+var restrictingOptions = map[string]bool{
+	"dnstype": true,
+	"ctag":    true,
+}
+
+// optionName returns option without its value, e.g. csp for csp=script-src 'self'
+func optionName(option string) string {
+	if i := strings.IndexByte(option, '='); i >= 0 {
+		return option[:i]
+	}
+	return option
+}
+
+// isModifierName tells if name can be a name of a modifier, e.g. third-party or ~script
+func isModifierName(name string) bool {
+	name = strings.TrimPrefix(name, "~")
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// isRegexRule tells if rule text is a regular expression between slashes
+func (rule *rule) isRegexRule() bool {
+	return len(rule.text) > 1 && rule.text[0] == '/' && rule.text[len(rule.text)-1] == '/'
+}
+
 func (rule *rule) extractShortcut() {
 	// regex rules have no shortcuts
-	if rule.text[0] == '/' && rule.text[len(rule.text)-1] == '/' {
+	if rule.isRegexRule() {
 		return
 	}
 
@@ -390,16 +1142,59 @@ func (rule *rule) extractShortcut() {
 	rule.shortcut = strings.ToLower(longestField)
 }
 
-func (rule *rule) compile() error {
-	rule.RLock()
-	isCompiled := rule.isSuffix || rule.compiled != nil
-	rule.RUnlock()
-	if isCompiled {
-		return nil
+// isSuffixRule tells if rule can be matched without compiling it into regexp
+func (rule *rule) isSuffixRule() bool {
+	isSuffix, _ := getSuffix(rule.text)
+	if !isSuffix {
+		isSuffix, _ = getSubdomainsSuffix(rule.text)
 	}
+	return isSuffix
+}
 
-	isSuffix, suffix := getSuffix(rule.text)
-	if isSuffix {
+// needsRegexp tells if rule has to be compiled into regexp to match hostnames
+func (rule *rule) needsRegexp() bool {
+	return rule.network == nil && !rule.matchAll && rule.keyword == "" && rule.tldWildcard == "" && !rule.isSuffixRule()
+}
+
+// checkRegexp tells if regexp of the rule can be compiled without compiling it
+func (rule *rule) checkRegexp() error {
+	expr, err := ruleToRegexp(rule.text, rule.separatorClass)
+	if err != nil {
+		return &invalidRegexpError{err: err}
+	}
+	_, err = syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return &invalidRegexpError{err: err}
+	}
+	return nil
+}
+
+// pattern returns regexp that rule is matched with if it can't be matched by domain suffix
+func (rule *rule) pattern() (string, error) {
+	expr, err := ruleToRegexp(rule.text, rule.separatorClass)
+	if err != nil {
+		return "", err
+	}
+	if rule.isFullMatch && rule.text[0] == '/' && rule.text[len(rule.text)-1] == '/' {
+		expr = "^(?:" + expr + ")$"
+	}
+	return expr, nil
+}
+
+func (rule *rule) compile() error {
+	rule.RLock()
+	isCompiled := rule.isSuffix || rule.compiled != nil
+	rule.RUnlock()
+	if isCompiled {
+		return nil
+	}
+
+	isSuffix, suffix := getSuffix(rule.text)
+	if !isSuffix {
+		// apex is excluded by minLabels set in parseRule
+		isSuffix, suffix = getSubdomainsSuffix(rule.text)
+	}
+	if isSuffix {
 		rule.Lock()
 		rule.isSuffix = isSuffix
 		rule.suffix = suffix
@@ -407,11 +1202,15 @@ func (rule *rule) compile() error {
 		return nil
 	}
 
-	expr, err := ruleToRegexp(rule.text)
+	expr, err := rule.pattern()
 	if err != nil {
 		return err
 	}
 
+	if strings.ToLower(expr) != expr {
+		// hosts are lowercased before matching, so uppercase literals like /Example\.org/ would never match otherwise
+		expr = "(?i)" + expr
+	}
 	compiled, err := regexp.Compile(expr)
 	if err != nil {
 		return err
@@ -424,8 +1223,157 @@ func (rule *rule) compile() error {
 	return nil
 }
 
-func (rule *rule) match(host string) (Result, error) {
+func (rule *rule) isDisabled() bool {
+	return atomic.LoadUint32(&rule.disabled) != 0 || atomic.LoadUint32(&rule.badfiltered) != 0
+}
+
+// badfilterTarget returns text of the rule that $badfilter rule text disables, which is the same text without $badfilter
+// options are compared as written, except for whitespace around them
+func badfilterTarget(text string) string {
+	r := &rule{text: text}
+	if r.extractOptions() != nil {
+		return text
+	}
+	options := make([]string, 0, len(r.options))
+	for _, option := range r.options {
+		if option != "badfilter" {
+			options = append(options, option)
+		}
+	}
+	if len(options) == 0 {
+		return r.text
+	}
+	return r.text + "$" + strings.Join(options, ",")
+}
+
+// matchProtocol tells if rule applies to queries that came over protocol, rules with $protocol never apply if it's unknown
+func (rule *rule) matchProtocol(protocol string) bool {
+	if len(rule.protocols) == 0 {
+		return true
+	}
+	for _, p := range rule.protocols {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// matchClass tells if rule applies to queries of specified DNS class
+func (rule *rule) matchClass(qclass uint16) bool {
+	if len(rule.classes) == 0 {
+		return true
+	}
+	for _, c := range rule.classes {
+		if c == qclass {
+			return true
+		}
+	}
+	return false
+}
+
+// parseNetwork parses $client or $network option value, which is either an IP address or a CIDR
+func parseNetwork(value string) (*net.IPNet, error) {
+	if strings.IndexByte(value, '/') >= 0 {
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, ErrInvalidSyntax
+		}
+		return network, nil
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, ErrInvalidSyntax
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// matchClient tells if rule applies to the client that sent the query, see CheckHostForClient
+func (rule *rule) matchClient(q query) bool {
+	if len(rule.clients) == 0 {
+		return true
+	}
+	return matchClientNetworks(q, rule.clients)
+}
+
+// matchClientNetworks tells if the client that sent the query is inside one of networks
+func matchClientNetworks(q query, networks []*net.IPNet) bool {
+	for _, network := range networks {
+		if q.clientSubnet != nil {
+			ones, bits := q.clientSubnet.Mask.Size()
+			networkOnes, networkBits := network.Mask.Size()
+			// whole subnet has to be inside of rule's network
+			if bits == networkBits && ones >= networkOnes && network.Contains(q.clientSubnet.IP) {
+				return true
+			}
+		} else if q.clientIP != nil && network.Contains(q.clientIP) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchDomains tells if queried host satisfies $domain option of the rule
+func (rule *rule) matchDomains(host string) bool {
+	for _, domain := range rule.excluded {
+		if isSubdomain(host, domain) {
+			return false
+		}
+	}
+	if len(rule.domains) == 0 {
+		return true
+	}
+	for _, domain := range rule.domains {
+		if isSubdomain(host, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasMeaningfulDomains tells if $domain option of a domain suffix rule can be satisfied by any host the rule matches
+// for other rules it can't be known, so it's assumed to be meaningful
+func (rule *rule) hasMeaningfulDomains() bool {
+	isSuffix, suffix := getSuffix(rule.text)
+	if !isSuffix || len(rule.domains) == 0 {
+		return true
+	}
+	suffix = strings.ToLower(suffix)
+	for _, domain := range rule.domains {
+		if isSubdomain(domain, suffix) || isSubdomain(suffix, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *rule) match(q query) (Result, error) {
 	res := Result{}
+	if rule.isDisabled() {
+		return res, nil
+	}
+	if !rule.matchClass(q.qclass) || !rule.matchClient(q) || !rule.matchProtocol(q.protocol) || !rule.matchDomains(q.host) {
+		return res, nil
+	}
+	if rule.matchAll {
+		return rule.matchedResult(), nil
+	}
+	if rule.keyword != "" {
+		if hasLabel(q.host, rule.keyword) {
+			return rule.matchedResult(), nil
+		}
+		return res, nil
+	}
+	if rule.tldWildcard != "" {
+		if hasNameBeforePublicSuffix(q.host, rule.tldWildcard) {
+			return rule.matchedResult(), nil
+		}
+		return res, nil
+	}
+	host := q.host
 	err := rule.compile()
 	if err != nil {
 		return res, err
@@ -433,27 +1381,46 @@ func (rule *rule) match(host string) (Result, error) {
 	rule.RLock()
 	matched := false
 	if rule.isSuffix {
+		labels := -1
 		if host == rule.suffix {
-			matched = true
+			labels = 0
 		} else if strings.HasSuffix(host, "."+rule.suffix) {
-			matched = true
+			subdomain := host[:len(host)-len(rule.suffix)-1]
+			labels = strings.Count(subdomain, ".") + 1
 		}
+		matched = labels >= rule.minLabels && (!rule.hasLabels || labels == rule.labels)
 	} else {
-		matched = rule.compiled.MatchString(host)
+		matched = rule.compiled.MatchString(host) || (q.unicodeHost != "" && rule.compiled.MatchString(q.unicodeHost))
 	}
 	rule.RUnlock()
 	if matched {
-		res.Reason = FilteredBlackList
-		res.IsFiltered = true
-		if rule.isWhitelist {
-			res.Reason = NotFilteredWhiteList
-			res.IsFiltered = false
-		}
-		res.Rule = rule.text
+		res = rule.matchedResult()
 	}
 	return res, nil
 }
 
+// matchedResult returns result of a check that was decided by this rule
+func (rule *rule) matchedResult() Result {
+	res := Result{
+		Reason:     FilteredBlackList,
+		IsFiltered: true,
+		Rule:       rule.text,
+		RuleID:     rule.id,
+		FilterID:   rule.listID,
+		Comment:    rule.comment,
+	}
+	if rule.isWhitelist {
+		res.Reason = NotFilteredWhiteList
+		res.IsFiltered = false
+	} else if rule.rewrite != nil {
+		res.DNSRewrite = &DNSRewrite{
+			RCode: rule.rewrite.RCode,
+			IPs:   append([]net.IP(nil), rule.rewrite.IPs...),
+		}
+	}
+	return res
+}
+
 func getCachedReason(cache gcache.Cache, host string) (result Result, isFound bool, err error) {
 	isFound = false // not found yet
 
@@ -482,8 +1449,9 @@ func getCachedReason(cache gcache.Cache, host string) (result Result, isFound bo
 	return cachedValue, isFound, err
 }
 
-// for each dot, hash it and add it to string
-func hostnameToHashParam(host string, addslash bool) (string, map[string]bool) {
+// for each dot, hash it and add first prefixLen bytes of hash to string
+// if maxParents is positive, only host itself and maxParents of its parent domains closest to the public suffix are hashed
+func hostnameToHashParam(host string, addslash bool, prefixLen int, maxParents int) (string, map[string]bool) {
 	var hashparam bytes.Buffer
 	hashes := map[string]bool{}
 	tld, icann := publicsuffix.PublicSuffix(host)
@@ -491,6 +1459,7 @@ func hostnameToHashParam(host string, addslash bool) (string, map[string]bool) {
 		// private suffixes like cloudfront.net
 		tld = ""
 	}
+	hosts := []string{}
 	curhost := host
 	for {
 		if curhost == "" {
@@ -501,33 +1470,47 @@ func hostnameToHashParam(host string, addslash bool) (string, map[string]bool) {
 			// we've reached the TLD, don't hash it
 			break
 		}
-		tohash := []byte(curhost)
+		hosts = append(hosts, curhost)
+		pos := strings.IndexByte(curhost, byte('.'))
+		if pos < 0 {
+			break
+		}
+		curhost = curhost[pos+1:]
+	}
+	if maxParents > 0 && len(hosts) > maxParents+1 {
+		// like Safe Browsing does, skip the parents closest to the host, so that deep subdomains of listed domains are still found
+		hosts = append(hosts[:1], hosts[len(hosts)-maxParents:]...)
+	}
+
+	for _, h := range hosts {
+		tohash := []byte(h)
 		if addslash {
 			tohash = append(tohash, '/')
 		}
 		sum := sha256.Sum256(tohash)
 		hexhash := fmt.Sprintf("%X", sum)
 		hashes[hexhash] = true
-		hashparam.WriteString(fmt.Sprintf("%02X%02X%02X%02X/", sum[0], sum[1], sum[2], sum[3]))
-		pos := strings.IndexByte(curhost, byte('.'))
-		if pos < 0 {
-			break
-		}
-		curhost = curhost[pos+1:]
+		hashparam.WriteString(fmt.Sprintf("%X/", sum[:prefixLen]))
 	}
 	return hashparam.String(), hashes
 }
 
-func (d *Dnsfilter) checkSafeBrowsing(host string) (Result, error) {
+func (d *Dnsfilter) checkSafeBrowsing(ctx context.Context, host string) (Result, error) {
 	// prevent recursion -- checking the host of safebrowsing server makes no sense
 	if host == d.config.safeBrowsingServer {
 		return Result{}, nil
 	}
 	format := func(hashparam string) string {
+		if d.config.safeBrowsingProto == SafeBrowsingJSON {
+			return fmt.Sprintf(defaultSafebrowsingJSONURL, d.config.safeBrowsingServer, hashparam)
+		}
 		url := fmt.Sprintf(defaultSafebrowsingURL, d.config.safeBrowsingServer, hashparam)
 		return url
 	}
 	handleBody := func(body []byte, hashes map[string]bool) (Result, error) {
+		if d.config.safeBrowsingProto == SafeBrowsingJSON {
+			return handleSafeBrowsingJSON(body, hashes)
+		}
 		result := Result{}
 		scanner := bufio.NewScanner(strings.NewReader(string(body)))
 		for scanner.Scan() {
@@ -542,6 +1525,7 @@ func (d *Dnsfilter) checkSafeBrowsing(host string) (Result, error) {
 				result.IsFiltered = true
 				result.Reason = FilteredSafeBrowsing
 				result.Rule = splitted[0]
+				result.ThreatType = threatTypeFromList(splitted[0])
 				break
 			}
 		}
@@ -552,20 +1536,44 @@ func (d *Dnsfilter) checkSafeBrowsing(host string) (Result, error) {
 		}
 		return result, nil
 	}
-	if safebrowsingCache == nil {
-		safebrowsingCache = gcache.New(defaultCacheSize).LRU().Expiration(defaultCacheTime).Build()
-	}
-	result, err := d.lookupCommon(host, &stats.Safebrowsing, safebrowsingCache, true, format, handleBody)
+	cache, _ := lookupCaches()
+	result, err := d.lookupCommon(ctx, host, d.httpClient(), d.safeBrowsingLimit, &stats.Safebrowsing, cache, true, d.config.safeBrowsingPrefix, d.config.safeBrowsingDepth, format, handleBody)
 	return result, err
 }
 
-func (d *Dnsfilter) checkParental(host string) (Result, error) {
+// handleSafeBrowsingJSON parses response of safebrowsing server in SafeBrowsingJSON protocol
+func handleSafeBrowsingJSON(body []byte, hashes map[string]bool) (Result, error) {
+	var m []struct {
+		Hash string `json:"hash"`
+		List string `json:"list"`
+	}
+	err := json.Unmarshal(body, &m)
+	if err != nil {
+		// error, don't save cache
+		log.Printf("Couldn't parse json '%s': %s", body, err)
+		return Result{}, err
+	}
+
+	result := Result{}
+	for i := range m {
+		if hashes[strings.ToUpper(m[i].Hash)] {
+			result.IsFiltered = true
+			result.Reason = FilteredSafeBrowsing
+			result.Rule = m[i].List
+			result.ThreatType = threatTypeFromList(m[i].List)
+			break
+		}
+	}
+	return result, nil
+}
+
+func (d *Dnsfilter) checkParental(ctx context.Context, host string) (Result, error) {
 	// prevent recursion -- checking the host of parental safety server makes no sense
 	if host == d.config.parentalServer {
 		return Result{}, nil
 	}
 	format := func(hashparam string) string {
-		url := fmt.Sprintf(defaultParentalURL, d.config.parentalServer, hashparam, d.config.parentalSensitivity)
+		url := fmt.Sprintf(defaultParentalURL, d.config.parentalServer, hashparam, atomic.LoadInt32(&d.parentalSensitivity))
 		return url
 	}
 	handleBody := func(body []byte, hashes map[string]bool) (Result, error) {
@@ -593,20 +1601,113 @@ func (d *Dnsfilter) checkParental(host string) (Result, error) {
 				result.IsFiltered = true
 				result.Reason = FilteredParental
 				result.Rule = fmt.Sprintf("parental %s", m[i].Reason)
+				result.Category = m[i].Reason
 				break
 			}
 		}
 		return result, nil
 	}
-	if parentalCache == nil {
-		parentalCache = gcache.New(defaultCacheSize).LRU().Expiration(defaultCacheTime).Build()
-	}
-	result, err := d.lookupCommon(host, &stats.Parental, parentalCache, false, format, handleBody)
+	_, cache := lookupCaches()
+	result, err := d.lookupCommon(ctx, host, d.parentalClient(), nil, &stats.Parental, cache, false, defaultHashPrefixLen, 0, format, handleBody)
 	return result, err
 }
 
-// real implementation of lookup/check
-func (d *Dnsfilter) lookupCommon(host string, lookupstats *LookupStats, cache gcache.Cache, hashparamNeedSlash bool, format func(hashparam string) string, handleBody func(body []byte, hashes map[string]bool) (Result, error)) (Result, error) {
+// WouldLookup tells if CheckHost for hostname would do safebrowsing and parental HTTP lookups, because their results aren't cached
+// it only consults rules and caches, so it can be used to answer quickly and do the check in background
+// hostnames decided by rules or blocked by SetBlockedTLDs never need lookups, and parental lookup isn't needed if cached safebrowsing result filters the host
+func (d *Dnsfilter) WouldLookup(hostname string) (safebrowsing, parental bool) {
+	return d.wouldLookup(query{host: hostname, qclass: classINET})
+}
+
+// WouldLookupForClient is like WouldLookup, but for CheckHostForClient, so rules with $client and SetSafeBrowsingExemptClients are taken into account
+func (d *Dnsfilter) WouldLookupForClient(hostname string, clientIP net.IP, ecs *net.IPNet) (safebrowsing, parental bool) {
+	return d.wouldLookup(query{host: hostname, qclass: classINET, clientIP: clientIP, clientSubnet: ecs})
+}
+
+// wouldLookup skips the lookups in the same order as check does
+func (d *Dnsfilter) wouldLookup(q query) (safebrowsing, parental bool) {
+	if d.isFilteringDisabled() {
+		return false, false
+	}
+	if d.config.strictHostValidation {
+		if _, stripped := stripSchemeAndPort(strings.TrimSpace(q.host)); stripped {
+			return false, false
+		}
+	}
+	host := normalizeHost(q.host)
+	if host == "" || d.isFastPass(host) || !isValidHost(host) {
+		return false, false
+	}
+	if d.config.idnaNormalization {
+		ascii, err := idna.ToASCII(host)
+		if err != nil {
+			return false, false
+		}
+		host = ascii
+	}
+	if d.config.strictHostValidation && !isStrictHost(host) {
+		return false, false
+	}
+	if isFlagSet(&d.destroyed) {
+		return false, false
+	}
+	q.host = host
+	res, err := d.matchHost(q)
+	if err != nil || res.Reason.Matched() {
+		return false, false
+	}
+	if _, blocked := blockedTLD(host, d.config.blockedTLDs); blocked {
+		return false, false
+	}
+
+	safebrowsingCache, parentalCache := lookupCaches()
+	exempt := matchClientNetworks(q, d.config.safeBrowsingExempt)
+	if isFlagSet(&d.safeBrowsingEnabled) && !exempt && host != d.config.safeBrowsingServer {
+		cached, found := isLookupCached(safebrowsingCache, host)
+		if !found {
+			safebrowsing = true
+		} else if cached.Reason.Matched() {
+			return false, false
+		}
+	}
+	if isFlagSet(&d.parentalEnabled) && host != d.config.parentalServer {
+		_, found := isLookupCached(parentalCache, host)
+		parental = !found
+	}
+	return safebrowsing, parental
+}
+
+// isLookupCached returns cached safebrowsing or parental result for normalized host
+func isLookupCached(cache gcache.Cache, host string) (Result, bool) {
+	cached, found, err := getCachedReason(cache, host)
+	return cached, found && err == nil
+}
+
+// parentalClient returns http client for parental lookups
+func (d *Dnsfilter) parentalClient() *http.Client {
+	if d.parentalTransport == nil {
+		return d.httpClient()
+	}
+	client := *d.httpClient()
+	client.Transport = d.parentalTransport
+	return &client
+}
+
+// httpClient returns http client for safebrowsing and parental lookups and filter list downloads
+func (d *Dnsfilter) httpClient() *http.Client {
+	if d.customClient != nil {
+		return d.customClient
+	}
+	return &d.client
+}
+
+// real implementation of lookup/check, ctx aborts the lookup, e.g. when Warmup is cancelled
+func (d *Dnsfilter) lookupCommon(ctx context.Context, host string, client *http.Client, limiter *rate.Limiter, lookupstats *LookupStats, cache gcache.Cache, hashparamNeedSlash bool, hashPrefixLen int, maxParents int, format func(hashparam string) string, handleBody func(body []byte, hashes map[string]bool) (Result, error)) (Result, error) {
+	if isFlagSet(&d.destroyed) {
+		// connections opened now would outlive Dnsfilter
+		return Result{}, nil
+	}
+
 	// if host ends with a dot, trim it
 	host = strings.ToLower(strings.Trim(host, "."))
 
@@ -621,16 +1722,91 @@ func (d *Dnsfilter) lookupCommon(host string, lookupstats *LookupStats, cache gc
 	}
 
 	// convert hostname to hash parameters
-	hashparam, hashes := hostnameToHashParam(host, hashparamNeedSlash)
+	hashparam, hashes := hostnameToHashParam(host, hashparamNeedSlash, hashPrefixLen, maxParents)
 
 	// format URL with our hashes
 	url := format(hashparam)
 
+	// concurrent lookups for the same host have the same hash prefixes in URL, so they share one HTTP request
+	shared := d.lookupGroup.DoChan(url, func() (interface{}, error) {
+		// it might have been cached by a lookup that finished just before this one started
+		cachedValue, isFound, err := getCachedReason(cache, host)
+		if isFound {
+			atomic.AddUint64(&lookupstats.CacheHits, 1)
+			return cachedValue, nil
+		}
+		if err != nil {
+			return Result{}, err
+		}
+		return d.doLookup(ctx, host, client, limiter, url, hashes, lookupstats, cache, handleBody)
+	})
+	var value interface{}
+	select {
+	case res := <-shared:
+		value, err = res.Val, res.Err
+	case <-ctx.Done():
+		return Result{}, ctx.Err()
+	}
+	if err != nil && errors.Is(err, context.Canceled) && ctx.Err() == nil && !isFlagSet(&d.destroyed) {
+		// shared request was cancelled by the lookup that started it, not by us
+		value, err = d.doLookup(ctx, host, client, limiter, url, hashes, lookupstats, cache, handleBody)
+	}
+	if err != nil {
+		if isFlagSet(&d.destroyed) {
+			// aborted by Destroy
+			return Result{}, nil
+		}
+		return Result{}, err
+	}
+	return value.(Result), nil
+}
+
+// lookupContext returns context for HTTP lookup that is cancelled either with ctx or by Destroy
+func (d *Dnsfilter) lookupContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if ctx.Done() == nil {
+		// never cancelled
+		return context.WithCancel(d.lookupCtx)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-d.lookupCtx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// doLookup does HTTP request for lookupCommon and caches the result
+func (d *Dnsfilter) doLookup(ctx context.Context, host string, client *http.Client, limiter *rate.Limiter, url string, hashes map[string]bool, lookupstats *LookupStats, cache gcache.Cache, handleBody func(body []byte, hashes map[string]bool) (Result, error)) (Result, error) {
+	ctx, cancel := d.lookupContext(ctx)
+	defer cancel()
+	if limiter != nil {
+		// wait for our turn, but not longer than the request itself could take
+		waitCtx := ctx
+		if client.Timeout > 0 {
+			var cancelWait context.CancelFunc
+			waitCtx, cancelWait = context.WithTimeout(ctx, client.Timeout)
+			defer cancelWait()
+		}
+		if limiter.Wait(waitCtx) != nil {
+			// error, don't save cache
+			return Result{}, ErrRateLimited
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return Result{}, err
+	}
+	req.Header.Set("User-Agent", d.config.userAgent)
+
 	// do HTTP request
 	atomic.AddUint64(&lookupstats.Requests, 1)
 	atomic.AddInt64(&lookupstats.Pending, 1)
 	updateMax(&lookupstats.Pending, &lookupstats.PendingMax)
-	resp, err := d.client.Get(url)
+	resp, err := client.Do(req)
 	atomic.AddInt64(&lookupstats.Pending, -1)
 	if resp != nil && resp.Body != nil {
 		defer resp.Body.Close()
@@ -679,24 +1855,161 @@ func (d *Dnsfilter) lookupCommon(host string, lookupstats *LookupStats, cache gc
 //
 
 // AddRule adds a rule, checking if it is a valid rule first and if it wasn't added already
+// besides usual domain rules like ||example.org^, that match example.org and its subdomains, ||*.example.org^ can be used to match subdomains only
+// hosts are always lowercased before matching, so rules are case-insensitive, including uppercase literals in /regexp/ rules
+//
+// when several rules match the host, the first of these decides the result:
+//   - rules disabled by $badfilter rules, and rules with $denyallow or $domain=~ excluding the host, never match
+//   - whitelist rules with $important
+//   - other rules with $important
+//   - whitelist rules, then other rules, or the rule from filter list that comes first in SetFilterPriority if it's set
 func (d *Dnsfilter) AddRule(input string, filterListID uint32) error {
+	_, err := d.AddRuleID(input, filterListID)
+	return err
+}
+
+// AddRuleID is like AddRule, but also returns ID assigned to the added rule
+func (d *Dnsfilter) AddRuleID(input string, filterListID uint32) (uint64, error) {
+	id, err := d.addRule(input, filterListID, "")
+	return id, publicError(err)
+}
+
+// AddRuleWithComment is like AddRule, but also stores a comment that is reported back in Result and Rules
+// comment doesn't affect matching
+func (d *Dnsfilter) AddRuleWithComment(input string, filterListID uint32, comment string) error {
+	_, err := d.addRule(input, filterListID, comment)
+	return publicError(err)
+}
+
+// AddAllowlistDomain makes domain and all its subdomains never filtered, regardless of other rules, safebrowsing and parental
+// it adds `@@||domain^$important` rule, which can be removed by its ID as reported by Rules
+func (d *Dnsfilter) AddAllowlistDomain(domain string) error {
+	domain = normalizeHost(domain)
+	if domain == "" || !isValidHost(domain) {
+		return ErrInvalidHost
+	}
+	_, err := d.addRule("@@||"+domain+"^$important", 0, "")
+	if err == errRuleExists {
+		return nil
+	}
+	return publicError(err)
+}
+
+// AddRuleChanged is like AddRule, but instead of failing it returns false if the rule was already added
+func (d *Dnsfilter) AddRuleChanged(input string, filterListID uint32) (bool, error) {
+	_, err := d.addRule(input, filterListID, "")
+	if err == errRuleExists {
+		return false, nil
+	}
+	return err == nil, publicError(err)
+}
+
+func (d *Dnsfilter) addRule(input string, filterListID uint32, comment string) (uint64, error) {
+	id, err := d.addRuleLine(input, filterListID, comment, 0)
+	if _, ok := err.(*skippedRuleError); ok {
+		return 0, ErrInvalidSyntax
+	}
+	return id, err
+}
+
+// addRuleLine is addRule for rule read from line lineNo of a list, it returns *skippedRuleError for rules that were skipped
+func (d *Dnsfilter) addRuleLine(input string, filterListID uint32, comment string, lineNo int) (uint64, error) {
 	input = strings.TrimSpace(input)
 	d.storageMutex.RLock()
 	_, exists := d.storage[input]
 	d.storageMutex.RUnlock()
 	if exists {
-		// already added
-		return ErrInvalidSyntax
+		return 0, errRuleExists
+	}
+
+	rule, err := d.parseRule(input, filterListID, comment)
+	if skipped, ok := err.(*skippedRuleError); ok {
+		d.addSkippedRule(input, skipped.reason, lineNo)
+		return 0, skipped
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	destination := d.tableForRule(rule)
+
+	d.storageMutex.Lock()
+	// it might have been added concurrently while it was parsed
+	if _, exists := d.storage[input]; exists {
+		d.storageMutex.Unlock()
+		return 0, errRuleExists
+	}
+	if d.config.maxRules > 0 && len(d.rulesByID) >= d.config.maxRules {
+		d.storageMutex.Unlock()
+		return 0, ErrRuleLimitExceeded
+	}
+	// assigned only to stored rules, so that IDs have no gaps
+	rule.id = atomic.AddUint64(&d.lastRuleID, 1)
+	d.storage[input] = rule
+	d.rulesByID[rule.id] = rule
+	d.filterCounts[rule.listID]++
+	d.addBadfilter(rule)
+	d.storageMutex.Unlock()
+	defer d.invalidateResults()
+	if rule.badfilter == "" {
+		destination.Add(rule)
+	}
+
+	d.updateRuleStats(rule, 1)
+	return rule.id, nil
+}
+
+// addBadfilter disables the rule targeted by $badfilter rule, or disables rule if it's targeted by one of already added $badfilter rules
+// caller must hold storageMutex for writing
+func (d *Dnsfilter) addBadfilter(rule *rule) {
+	if rule.badfilter == "" {
+		if d.badfilters[rule.originalText] > 0 {
+			atomic.StoreUint32(&rule.badfiltered, 1)
+		}
+		return
+	}
+	d.badfilters[rule.badfilter]++
+	if target, ok := d.storage[rule.badfilter]; ok {
+		atomic.StoreUint32(&target.badfiltered, 1)
+	}
+}
+
+// removeBadfilter re-enables the rule targeted by removed $badfilter rule unless other $badfilter rules target it too
+// caller must hold storageMutex for writing
+func (d *Dnsfilter) removeBadfilter(rule *rule) {
+	d.badfilters[rule.badfilter]--
+	if d.badfilters[rule.badfilter] > 0 {
+		return
 	}
+	delete(d.badfilters, rule.badfilter)
+	if target, ok := d.storage[rule.badfilter]; ok {
+		atomic.StoreUint32(&target.badfiltered, 0)
+	}
+}
+
+// skippedRuleError is returned by parseRule for rules with valid syntax that can't be used for DNS filtering
+type skippedRuleError struct {
+	reason string
+}
+
+func (e *skippedRuleError) Error() string {
+	return "dnsfilter: rule skipped: " + e.reason
+}
 
+// parseRule parses already trimmed rule text according to current settings
+func (d *Dnsfilter) parseRule(input string, filterListID uint32, comment string) (*rule, error) {
 	if !isValidRule(input) {
-		return ErrInvalidSyntax
+		return nil, ErrInvalidSyntax
 	}
 
-	rule := rule{
+	rule := &rule{
 		text:         input, // will be modified
 		originalText: input,
 		listID:       filterListID,
+		comment:      comment,
+		isFullMatch:  d.config.regexFullMatch,
+
+		separatorClass: d.config.separatorClass,
 	}
 
 	// mark rule as whitelist if it starts with @@
@@ -705,54 +2018,398 @@ func (d *Dnsfilter) AddRule(input string, filterListID uint32) error {
 		rule.text = rule.text[2:]
 	}
 
-	err := rule.parseOptions()
+	ignored := d.config.ignoredModifiers
+	if ignored == nil {
+		ignored = browserOnlyOptions
+	}
+	err := rule.parseOptions(d.config.acceptedModifiers, ignored)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if len(rule.unknownOptions) > 0 && d.config.strictModifiers {
+		// most likely a typo, like $imporant
+		return nil, ErrUnknownModifier
+	}
+	if len(rule.ignoredOptions) > 0 && (d.config.strictModifiers || len(rule.ignoredOptions) == len(rule.options)) {
+		// nothing left to filter by DNS, or we were asked not to apply rules partially
+		return nil, &skippedRuleError{reason: "unsupported modifiers: " + strings.Join(rule.ignoredOptions, ",")}
 	}
 
-	rule.extractShortcut()
-
-	if !enableDelayedCompilation {
-		err := rule.compile()
-		if err != nil {
-			return err
+	if !hasValidAnchors(rule.text) {
+		return nil, ErrInvalidSyntax
+	}
+	if !rule.hasMeaningfulDomains() {
+		// in browsers $domain restricts the pages rule applies on, hostname itself is never in these domains
+		if d.config.strictModifiers {
+			return nil, &skippedRuleError{reason: "$domain can never match hostnames of the rule"}
 		}
+		rule.domains = nil
+	}
+	if !rule.isRegexRule() {
+		rule.text = trimRuleTrailingDot(rule.text)
+	}
+	// ||*.example.org^ blocks subdomains only, so at least one label has to precede the domain
+	if isSubdomains, _ := getSubdomainsSuffix(rule.text); isSubdomains && rule.minLabels == 0 {
+		rule.minLabels = 1
+	}
+	if d.config.idnaNormalization && !rule.isRegexRule() {
+		rule.text = punycodeRule(rule.text)
 	}
 
-	destination := d.blackList
-	if rule.isImportant {
-		destination = d.important
-	} else if rule.isWhitelist {
-		destination = d.whiteList
+	rule.extractNetwork()
+	rule.matchAll = rule.text == "*" || rule.text == "||*^"
+	if d.config.keywordRules && rule.network == nil && isKeyword(rule.text) {
+		rule.keyword = strings.ToLower(rule.text)
+	}
+	if d.config.publicSuffixWildcards && rule.network == nil {
+		if ok, name := getPublicSuffixWildcard(rule.text); ok {
+			rule.tldWildcard = strings.ToLower(name)
+		}
 	}
 
-	d.storageMutex.Lock()
-	d.storage[input] = &rule
-	d.storageMutex.Unlock()
-	destination.Add(&rule)
-	return nil
-}
+	if d.config.regexRulesDisabled && rule.needsRegexp() {
+		return nil, ErrRegexRulesDisabled
+	}
 
-// matchHost is a low-level way to check only if hostname is filtered by rules, skipping expensive safebrowsing and parental lookups
-func (d *Dnsfilter) matchHost(host string) (Result, error) {
-	lists := []*rulesTable{
-		d.important,
-		d.whiteList,
-		d.blackList,
+	rule.extractShortcut()
+	if d.config.idnaNormalization && !isASCII(rule.shortcut) {
+		// hostnames are punycoded, so Unicode shortcut would never be found
+		rule.shortcut = ""
 	}
 
-	for _, table := range lists {
-		res, err := table.matchByHost(host)
+	if rule.needsRegexp() {
+		// compilation is delayed until first match, but broken regexps must be rejected now
+		err = rule.checkRegexp()
 		if err != nil {
-			return res, err
+			return nil, err
 		}
-		if res.Reason.Matched() {
-			return res, nil
+	}
+
+	if !enableDelayedCompilation {
+		err := rule.compile()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rule, nil
+}
+
+// MatchRule tells if a single rule matches hostname, without adding the rule
+// rule is parsed according to current settings, and ErrInvalidSyntax is returned if it can't be added
+// IP rules are matched against hostname that is an IP address
+func (d *Dnsfilter) MatchRule(input string, hostname string) (bool, error) {
+	rule, err := d.parseRule(strings.TrimSpace(input), 0, "")
+	if err != nil {
+		return false, publicError(err)
+	}
+	host := normalizeHost(hostname)
+	if host == "" {
+		return false, nil
+	}
+	if rule.network != nil {
+		ip := net.ParseIP(host)
+		return ip != nil && rule.network.Contains(ip), nil
+	}
+	if !isValidHost(host) {
+		return false, ErrInvalidHost
+	}
+	res, err := rule.match(query{host: host, qclass: classINET})
+	if err != nil {
+		return false, err
+	}
+	return res.Reason.Matched(), nil
+}
+
+func (d *Dnsfilter) addSkippedRule(text string, reason string, lineNo int) {
+	d.skippedMutex.Lock()
+	d.skipped = append(d.skipped, SkippedRule{Text: text, Reason: reason, Line: lineNo})
+	d.skippedMutex.Unlock()
+}
+
+// SkippedRules returns rules that were rejected by AddRule because they can't be applied to DNS filtering
+func (d *Dnsfilter) SkippedRules() []SkippedRule {
+	d.skippedMutex.Lock()
+	defer d.skippedMutex.Unlock()
+	return append([]SkippedRule{}, d.skipped...)
+}
+
+// RemoveRuleByID removes rule with specified ID, returns false if there is no such rule
+func (d *Dnsfilter) RemoveRuleByID(id uint64) bool {
+	d.storageMutex.Lock()
+	rule, ok := d.rulesByID[id]
+	if ok {
+		delete(d.rulesByID, id)
+		delete(d.storage, rule.originalText)
+		d.filterCounts[rule.listID]--
+		if d.filterCounts[rule.listID] == 0 {
+			delete(d.filterCounts, rule.listID)
+		}
+		if rule.badfilter != "" {
+			d.removeBadfilter(rule)
+		}
+	}
+	d.storageMutex.Unlock()
+	if !ok {
+		return false
+	}
+	defer d.invalidateResults()
+	if rule.badfilter == "" {
+		d.tableForRule(rule).Remove(rule)
+	}
+	d.updateRuleStats(rule, -1)
+	return true
+}
+
+// DisableRuleByID makes rule with specified ID to be skipped during matching, returns false if there is no such rule
+func (d *Dnsfilter) DisableRuleByID(id uint64) bool {
+	return d.setRuleDisabled(id, 1)
+}
+
+// EnableRuleByID re-enables rule previously disabled by DisableRuleByID, returns false if there is no such rule
+func (d *Dnsfilter) EnableRuleByID(id uint64) bool {
+	return d.setRuleDisabled(id, 0)
+}
+
+func (d *Dnsfilter) setRuleDisabled(id uint64, disabled uint32) bool {
+	d.storageMutex.RLock()
+	rule, ok := d.rulesByID[id]
+	d.storageMutex.RUnlock()
+	if ok {
+		atomic.StoreUint32(&rule.disabled, disabled)
+		d.invalidateResults()
+	}
+	return ok
+}
+
+// countHit increments hit counter of the rule that decided the result
+func (d *Dnsfilter) countHit(id uint64) {
+	d.storageMutex.RLock()
+	rule, ok := d.rulesByID[id]
+	d.storageMutex.RUnlock()
+	if ok {
+		atomic.AddUint64(&rule.hits, 1)
+	}
+}
+
+// RuleHits returns how many times each rule decided the result of a check, keyed by rule ID
+// rules that never matched are reported with zero hits so they can be found and pruned
+func (d *Dnsfilter) RuleHits() map[uint64]uint64 {
+	d.storageMutex.RLock()
+	defer d.storageMutex.RUnlock()
+	hits := make(map[uint64]uint64, len(d.rulesByID))
+	for id, rule := range d.rulesByID {
+		hits[id] = atomic.LoadUint64(&rule.hits)
+	}
+	return hits
+}
+
+// ResetHits zeroes hit counters of all rules, rules themselves are kept
+func (d *Dnsfilter) ResetHits() {
+	d.storageMutex.RLock()
+	defer d.storageMutex.RUnlock()
+	for _, rule := range d.rulesByID {
+		atomic.StoreUint64(&rule.hits, 0)
+	}
+}
+
+// Compact reclaims memory left unused after removal of many rules, it can be called when there are few checks
+// rules and the order they are matched in are not changed
+func (d *Dnsfilter) Compact() {
+	d.storageMutex.Lock()
+	storage := make(map[string]*rule, len(d.storage))
+	for text, rule := range d.storage {
+		storage[text] = rule
+	}
+	d.storage = storage
+	rulesByID := make(map[uint64]*rule, len(d.rulesByID))
+	for id, rule := range d.rulesByID {
+		rulesByID[id] = rule
+	}
+	d.rulesByID = rulesByID
+	d.storageMutex.Unlock()
+
+	for _, table := range d.tables() {
+		table.compact()
+	}
+}
+
+// RemoveAllRules removes all added rules along with their hit counters, settings are kept
+// use ResetHits to clear hit counters only
+func (d *Dnsfilter) RemoveAllRules() {
+	d.storageMutex.Lock()
+	d.storage = make(map[string]*rule)
+	d.rulesByID = make(map[uint64]*rule)
+	d.filterCounts = make(map[uint32]int)
+	d.badfilters = make(map[string]int)
+	d.storageMutex.Unlock()
+	defer d.invalidateResults()
+	for _, table := range d.tables() {
+		table.Lock()
+		table.rulesByShortcut = make(map[string][]*rule)
+		table.rulesLeftovers = make([]*rule, 0)
+		table.rulesByNetwork = nil
+		table.rulesMatchAll = nil
+		table.Unlock()
+	}
+	atomic.StoreInt64(&d.regexCount, 0)
+	atomic.StoreInt64(&d.regexBytes, 0)
+	atomic.StoreInt64(&d.whitelistCount, 0)
+	atomic.StoreInt64(&d.blacklistCount, 0)
+	atomic.StoreInt64(&d.badfilterCount, 0)
+	d.filterMetaMutex.Lock()
+	d.filterMeta = make(map[uint32]FilterMeta)
+	d.filterMetaMutex.Unlock()
+}
+
+// tableForRule returns rules table that rule is checked in
+func (d *Dnsfilter) tableForRule(rule *rule) *rulesTable {
+	if rule.isImportant && rule.isWhitelist {
+		return d.importantWhiteList
+	} else if rule.isImportant {
+		return d.important
+	} else if rule.isWhitelist {
+		return d.whiteList
+	}
+	return d.blackList
+}
+
+// updateRuleStats accounts added (delta = 1) or removed (delta = -1) rule in WhitelistCount, BlacklistCount, BadfilterCount and RegexStats
+func (d *Dnsfilter) updateRuleStats(rule *rule, delta int64) {
+	if rule.badfilter != "" {
+		atomic.AddInt64(&d.badfilterCount, delta)
+		return
+	}
+	if rule.isWhitelist {
+		atomic.AddInt64(&d.whitelistCount, delta)
+	} else {
+		atomic.AddInt64(&d.blacklistCount, delta)
+	}
+	if !rule.needsRegexp() {
+		return
+	}
+	expr, err := ruleToRegexp(rule.text, rule.separatorClass)
+	if err != nil {
+		return
+	}
+	atomic.AddInt64(&d.regexCount, delta)
+	atomic.AddInt64(&d.regexBytes, delta*int64(len(expr)))
+}
+
+// matchHost is a low-level way to check only if hostname is filtered by rules, skipping expensive safebrowsing and parental lookups
+func (d *Dnsfilter) matchHost(q query) (Result, error) {
+	lists := d.tables()
+	if d.config.filterPriority != nil {
+		// only $important rules are checked in order
+		lists = lists[:2]
+	}
+
+	for _, table := range lists {
+		res, err := table.matchByHost(q, d.config.regexRulesDisabled)
+		if err != nil {
+			return res, err
 		}
+		if res.Reason.Matched() {
+			return d.accumulateRewrites(table, q, res)
+		}
+	}
+	if d.config.filterPriority != nil {
+		return d.matchByPriority(q)
 	}
 	return Result{}, nil
 }
 
+// IsWhitelisted is a fast pre-check that tells if hostname matches a whitelist rule, including ones added by AddAllowlistDomain
+// blacklist rules, safebrowsing and parental are not consulted, so a host matching both @@ rule and $important rule is reported as whitelisted, unlike in CheckHost
+func (d *Dnsfilter) IsWhitelisted(hostname string) bool {
+	q := query{host: normalizeHost(hostname), qclass: classINET}
+	if d.isFilteringDisabled() || q.host == "" || !isValidHost(q.host) {
+		return false
+	}
+	for _, table := range []*rulesTable{d.importantWhiteList, d.whiteList} {
+		res, err := table.matchByHost(q, d.config.regexRulesDisabled)
+		if err == nil && res.Reason.Matched() {
+			return true
+		}
+	}
+	return false
+}
+
+// tables returns rules tables in the order they are checked
+func (d *Dnsfilter) tables() []*rulesTable {
+	return []*rulesTable{
+		d.importantWhiteList,
+		d.important,
+		d.whiteList,
+		d.blackList,
+	}
+}
+
+// matchByPriority picks matching whitelist or blacklist rule from the filter list with highest priority
+// whitelist rule wins if both are from the same filter list, and of the rules of the same kind the one added first wins
+func (d *Dnsfilter) matchByPriority(q query) (Result, error) {
+	var best *rule
+	for _, table := range []*rulesTable{d.whiteList, d.blackList} {
+		rules, err := table.matchAllByHost(q, d.config.regexRulesDisabled)
+		if err != nil {
+			return Result{}, err
+		}
+		for _, rule := range rules {
+			if best == nil || d.filterRank(rule.listID) < d.filterRank(best.listID) ||
+				(d.filterRank(rule.listID) == d.filterRank(best.listID) && rule.isWhitelist == best.isWhitelist && rule.id < best.id) {
+				best = rule
+			}
+		}
+	}
+	if best == nil {
+		return Result{}, nil
+	}
+	return d.accumulateRewrites(d.tableForRule(best), q, best.matchedResult())
+}
+
+// accumulateRewrites adds addresses of all $dnsrewrite=IP rules from table that match the host to result decided by one of them
+// this way several rules for the same host give answer with several addresses, rules from other tables don't contribute
+func (d *Dnsfilter) accumulateRewrites(table *rulesTable, q query, res Result) (Result, error) {
+	if res.DNSRewrite == nil || len(res.DNSRewrite.IPs) == 0 {
+		return res, nil
+	}
+	rules, err := table.matchAllByHost(q, d.config.regexRulesDisabled)
+	if err != nil {
+		return res, err
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].id < rules[j].id })
+	ips := []net.IP{}
+	for _, rule := range rules {
+		if rule.rewrite == nil {
+			continue
+		}
+		for _, ip := range rule.rewrite.IPs {
+			if !containsIP(ips, ip) {
+				ips = append(ips, ip)
+			}
+		}
+	}
+	res.DNSRewrite.IPs = ips
+	return res, nil
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, other := range ips {
+		if other.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterRank returns position of filter list in priority order, lower is more important
+// lists that weren't passed to SetFilterPriority go after the ones that were, lower ID first
+func (d *Dnsfilter) filterRank(filterListID uint32) uint64 {
+	if rank, ok := d.config.filterPriority[filterListID]; ok {
+		return uint64(rank)
+	}
+	return uint64(len(d.config.filterPriority)) + uint64(filterListID)
+}
+
 //
 // lifecycle helper functions
 //
@@ -762,6 +2419,11 @@ func New() *Dnsfilter {
 	d := new(Dnsfilter)
 
 	d.storage = make(map[string]*rule)
+	d.rulesByID = make(map[uint64]*rule)
+	d.filterCounts = make(map[uint32]int)
+	d.badfilters = make(map[string]int)
+	d.filterMeta = make(map[uint32]FilterMeta)
+	d.importantWhiteList = newRulesTable()
 	d.important = newRulesTable()
 	d.whiteList = newRulesTable()
 	d.blackList = newRulesTable()
@@ -780,15 +2442,153 @@ func New() *Dnsfilter {
 		Timeout:   defaultHTTPTimeout,
 	}
 	d.config.safeBrowsingServer = defaultSafebrowsingServer
+	d.config.safeBrowsingPrefix = defaultHashPrefixLen
 	d.config.parentalServer = defaultParentalServer
+	d.config.userAgent = defaultUserAgent
+	d.resolve = defaultResolve
+	d.safeSearchCache.ttl = defaultSafeSearchCacheTTL
+	d.lookupCtx, d.cancelLookups = context.WithCancel(context.Background())
 
 	return d
 }
 
+// NewAllowlist creates DNS Filter that blocks everything except domains and their subdomains, e.g. for guest networks
+// allowed hosts are reported as NotFilteredWhiteList and the rest as FilteredBlackList, invalid domains are skipped
+func NewAllowlist(domains []string) *Dnsfilter {
+	d := New()
+	// matched without regexp or shortcuts
+	d.AddRule("*", 0)
+	for _, domain := range domains {
+		domain = normalizeHost(domain)
+		if domain == "" || !isValidHost(domain) {
+			continue
+		}
+		d.AddRule("@@||"+domain+"^", 0)
+	}
+	return d
+}
+
+// Clone returns a copy of Dnsfilter with the same rules, rule IDs and settings that can be modified independently of the original
+// this allows to prepare updated rules while the original keeps serving checks, and then swap them
+// only the HTTP transport for safebrowsing and parental lookups is shared, safebrowsing and parental caches are global anyway
+func (d *Dnsfilter) Clone() *Dnsfilter {
+	c := New()
+	c.client = d.client
+	c.customClient = d.customClient
+	c.parentalTransport = d.parentalTransport
+	if d.safeBrowsingLimit != nil {
+		c.safeBrowsingLimit = rate.NewLimiter(d.safeBrowsingLimit.Limit(), d.safeBrowsingLimit.Burst())
+	}
+	c.config = d.config
+	if d.config.filterPriority != nil {
+		c.config.filterPriority = make(map[uint32]int, len(d.config.filterPriority))
+		for id, rank := range d.config.filterPriority {
+			c.config.filterPriority[id] = rank
+		}
+	}
+	c.filteringDisabled = atomic.LoadUint32(&d.filteringDisabled)
+	c.safeBrowsingEnabled = atomic.LoadUint32(&d.safeBrowsingEnabled)
+	c.parentalEnabled = atomic.LoadUint32(&d.parentalEnabled)
+	c.safeSearchEnabled = atomic.LoadUint32(&d.safeSearchEnabled)
+	c.parentalSensitivity = atomic.LoadInt32(&d.parentalSensitivity)
+	c.matchHook = d.matchHook
+	c.skipLog = d.skipLog
+	c.SetResultCache(d.config.resultCacheSize)
+	c.resolve = d.resolve
+	c.safeSearchCache.ttl = d.safeSearchCache.ttl
+
+	d.skippedMutex.Lock()
+	c.skipped = append([]SkippedRule{}, d.skipped...)
+	d.skippedMutex.Unlock()
+
+	d.fastPassMutex.RLock()
+	c.fastPass = d.fastPass // never modified, only replaced
+	d.fastPassMutex.RUnlock()
+
+	d.filterMetaMutex.Lock()
+	for id, meta := range d.filterMeta {
+		c.filterMeta[id] = meta
+	}
+	d.filterMetaMutex.Unlock()
+
+	d.storageMutex.RLock()
+	rules := make([]*rule, 0, len(d.rulesByID))
+	for _, rule := range d.rulesByID {
+		rules = append(rules, cloneRule(rule))
+	}
+	c.lastRuleID = atomic.LoadUint64(&d.lastRuleID)
+	d.storageMutex.RUnlock()
+
+	// keep the order in which rules are matched
+	sort.Slice(rules, func(i, j int) bool { return rules[i].id < rules[j].id })
+	for _, rule := range rules {
+		c.storage[rule.originalText] = rule
+		c.rulesByID[rule.id] = rule
+		c.filterCounts[rule.listID]++
+		if rule.badfilter != "" {
+			// badfiltered flags of its targets are cloned as is
+			c.badfilters[rule.badfilter]++
+			c.updateRuleStats(rule, 1)
+			continue
+		}
+		c.tableForRule(rule).Add(rule)
+		c.updateRuleStats(rule, 1)
+	}
+	return c
+}
+
+// cloneRule returns a copy of the rule, compiled regexp is immutable and is shared
+func cloneRule(r *rule) *rule {
+	r.RLock()
+	defer r.RUnlock()
+	return &rule{
+		text:           r.text,
+		shortcut:       r.shortcut,
+		originalText:   r.originalText,
+		options:        append([]string(nil), r.options...),
+		ignoredOptions: append([]string(nil), r.ignoredOptions...),
+		unknownOptions: append([]string(nil), r.unknownOptions...),
+		apps:           append([]string(nil), r.apps...),
+		classes:        append([]uint16(nil), r.classes...),
+		clients:        append([]*net.IPNet(nil), r.clients...),
+		protocols:      append([]string(nil), r.protocols...),
+		domains:        append([]string(nil), r.domains...),
+		excluded:       append([]string(nil), r.excluded...),
+		minLabels:      r.minLabels,
+		labels:         r.labels,
+		hasLabels:      r.hasLabels,
+		matchAll:       r.matchAll,
+		keyword:        r.keyword,
+		tldWildcard:    r.tldWildcard,
+		rewrite:        r.rewrite,
+		isWhitelist:    r.isWhitelist,
+		isImportant:    r.isImportant,
+		isFullMatch:    r.isFullMatch,
+		separatorClass: r.separatorClass,
+		badfilter:      r.badfilter,
+		listID:         r.listID,
+		comment:        r.comment,
+		id:             r.id,
+		disabled:       atomic.LoadUint32(&r.disabled),
+		badfiltered:    atomic.LoadUint32(&r.badfiltered),
+		hits:           atomic.LoadUint64(&r.hits),
+		isSuffix:       r.isSuffix,
+		suffix:         r.suffix,
+		compiled:       r.compiled,
+		network:        r.network,
+	}
+}
+
 // Destroy is optional if you want to tidy up goroutines without waiting for them to die off
-// right now it closes idle HTTP connections if there are any
+// right now it aborts in-flight safebrowsing and parental lookups, which then don't filter anything, and closes idle HTTP connections if there are any
+// it's safe to call it more than once and concurrently with checks, checks after it are done without safebrowsing and parental lookups
 func (d *Dnsfilter) Destroy() {
-	if d != nil && d.transport != nil {
+	if d == nil {
+		return
+	}
+	setFlag(&d.destroyed, true)
+	d.cancelLookups()
+	if d.transport != nil {
 		d.transport.CloseIdleConnections()
 	}
 }
@@ -797,27 +2597,69 @@ func (d *Dnsfilter) Destroy() {
 // config manipulation helpers
 //
 
+// SetEnabled lets you temporarily turn off all filtering without losing added rules
+// when disabled, CheckHost and CheckIP don't filter anything and don't consult rules, safebrowsing or parental
+// it's safe to call while checks are running, e.g. to stop filtering on a live server during an incident
+func (d *Dnsfilter) SetEnabled(enabled bool) {
+	setFlag(&d.filteringDisabled, !enabled)
+}
+
+// isFilteringDisabled tells if filtering was turned off by SetEnabled
+func (d *Dnsfilter) isFilteringDisabled() bool {
+	return isFlagSet(&d.filteringDisabled)
+}
+
+// setFlag atomically stores flag like safeBrowsingEnabled
+func setFlag(flag *uint32, on bool) {
+	value := uint32(0)
+	if on {
+		value = 1
+	}
+	atomic.StoreUint32(flag, value)
+}
+
+// isFlagSet atomically loads flag stored by setFlag
+func isFlagSet(flag *uint32) bool {
+	return atomic.LoadUint32(flag) != 0
+}
+
 // EnableSafeBrowsing turns on checking hostnames in malware/phishing database
+// this and other Enable and Disable methods are safe to call while checks are running
 func (d *Dnsfilter) EnableSafeBrowsing() {
-	d.config.safeBrowsingEnabled = true
+	setFlag(&d.safeBrowsingEnabled, true)
+}
+
+// DisableSafeBrowsing turns off checking hostnames in malware/phishing database
+func (d *Dnsfilter) DisableSafeBrowsing() {
+	setFlag(&d.safeBrowsingEnabled, false)
 }
 
 // EnableParental turns on checking hostnames for containing adult content
 func (d *Dnsfilter) EnableParental(sensitivity int) error {
 	switch sensitivity {
 	case 3, 10, 13, 17:
-		d.config.parentalSensitivity = sensitivity
-		d.config.parentalEnabled = true
+		atomic.StoreInt32(&d.parentalSensitivity, int32(sensitivity))
+		setFlag(&d.parentalEnabled, true)
 		return nil
 	default:
 		return ErrInvalidParental
 	}
 }
 
+// DisableParental turns off checking hostnames for containing adult content
+func (d *Dnsfilter) DisableParental() {
+	setFlag(&d.parentalEnabled, false)
+}
+
 // EnableSafeSearch turns on enforcing safesearch in search engines
 // only used in coredns plugin and requires caller to use SafeSearchDomain()
 func (d *Dnsfilter) EnableSafeSearch() {
-	d.config.safeSearchEnabled = true
+	setFlag(&d.safeSearchEnabled, true)
+}
+
+// DisableSafeSearch turns off enforcing safesearch in search engines
+func (d *Dnsfilter) DisableSafeSearch() {
+	setFlag(&d.safeSearchEnabled, false)
 }
 
 // SetSafeBrowsingServer lets you optionally change hostname of safesearch lookup
@@ -829,21 +2671,323 @@ func (d *Dnsfilter) SetSafeBrowsingServer(host string) {
 	}
 }
 
-// SetHTTPTimeout lets you optionally change timeout during lookups
+// SafeBrowsingProtocol is the wire format of safebrowsing lookups, see SetSafeBrowsingProtocol
+//
+// in both formats hostname and its parent domains down to the public suffix are hashed with SHA-256 as `host/`,
+// and first bytes of the hashes (see SetSafeBrowsingHashPrefixLen) are sent as uppercase hex, each followed by a slash:
+//
+//	GET http://<server>/safebrowsing-lookup-hash.html?prefixes=ABCD1234/5678EF90/
+//
+// the server answers with full hashes of known dangerous hosts that have these prefixes, so that the hostname itself isn't revealed
+type SafeBrowsingProtocol int
+
+const (
+	// SafeBrowsingLegacy is the default text protocol, response has a `list:chunk:HASH` line per hash, e.g.
+	//   adguard-malware-shavar:1:0123...CDEF
+	SafeBrowsingLegacy SafeBrowsingProtocol = iota
+	// SafeBrowsingJSON is the protocol of newer servers, request goes to /safebrowsing-lookup-hash.json and response is a JSON array:
+	//   [{"hash": "0123...CDEF", "list": "adguard-phishing-shavar"}]
+	SafeBrowsingJSON
+)
+
+// SetSafeBrowsingProtocol lets you optionally switch safebrowsing lookups to another wire format, unknown values select SafeBrowsingLegacy
+func (d *Dnsfilter) SetSafeBrowsingProtocol(proto SafeBrowsingProtocol) {
+	if proto != SafeBrowsingJSON {
+		proto = SafeBrowsingLegacy
+	}
+	d.config.safeBrowsingProto = proto
+}
+
+// SetBlockingIP lets you optionally set addresses that are reported in Result.BlockedResponse for blocked hosts, e.g. 0.0.0.0 and ::
+// by default, or if both are nil, blocked hosts should be answered with NXDOMAIN
+func (d *Dnsfilter) SetBlockingIP(ipv4, ipv6 net.IP) {
+	if ipv4 != nil {
+		ipv4 = ipv4.To4()
+	}
+	d.config.blockingIPv4 = ipv4
+	d.config.blockingIPv6 = ipv6
+}
+
+// SetStrictHostValidation lets you optionally make CheckHost return ErrInvalidHost for hostnames that don't conform to RFC 1035
+// labels must be 1 to 63 letters, digits and hyphens, not starting or ending with a hyphen, underscore is allowed only as first character, as in _sip._udp
+// it's off by default, so only hostnames with characters not allowed anywhere in domain names are rejected
+func (d *Dnsfilter) SetStrictHostValidation(strict bool) {
+	d.config.strictHostValidation = strict
+}
+
+// SetIDNANormalization lets you optionally match internationalized hostnames regardless of whether they are punycoded
+// when it's on, Unicode hostnames are converted to punycode before checks and Unicode labels of rules added after the call are converted too
+// regex rules and rules with wildcards inside Unicode labels, e.g. `||при*р.рф^`, can't be converted, so they are matched against both forms of the hostname instead
+func (d *Dnsfilter) SetIDNANormalization(enabled bool) {
+	d.config.idnaNormalization = enabled
+}
+
+// SetKeywordRules lets you optionally make rules that are just a single label, e.g. `doubleclick`, match hosts that have it as a whole label
+// e.g. it matches ad.doubleclick.net, but not mydoubleclickthing.com, as it would by default, it affects only rules added after the call
+func (d *Dnsfilter) SetKeywordRules(enabled bool) {
+	d.config.keywordRules = enabled
+}
+
+// SetPublicSuffixWildcards lets you optionally make rules like ||ads.*^ match ads followed by any public suffix, e.g. ads.com and ads.co.uk, and their subdomains
+// by default * matches anything, so such rule matches ads.example.com as well, it affects only rules added after the call
+func (d *Dnsfilter) SetPublicSuffixWildcards(enabled bool) {
+	d.config.publicSuffixWildcards = enabled
+}
+
+// SetSeparatorClass lets you optionally change what ^ matches in rules besides end of hostname, e.g. `[_-]` makes `|ads^` match ads-server.example.org
+// domain rules like `||doubleclick.net^` are not affected, they are matched by domain and their ^ always means end of hostname
+// class must be a regexp character class, ErrInvalidSeparatorClass is returned otherwise
+// empty class restores the default, it affects only rules added after the call
+func (d *Dnsfilter) SetSeparatorClass(class string) error {
+	if class != "" {
+		re, err := syntax.Parse(class, syntax.Perl)
+		if err != nil || (re.Op != syntax.OpCharClass && !(re.Op == syntax.OpLiteral && len(re.Rune) == 1)) {
+			return ErrInvalidSeparatorClass
+		}
+	}
+	d.config.separatorClass = class
+	return nil
+}
+
+// SetAcceptedModifiers lets you optionally name modifiers that don't restrict rules for DNS filtering, e.g. third-party
+// rules with such modifiers are added as if they didn't have them, it affects only rules added after the call
+func (d *Dnsfilter) SetAcceptedModifiers(modifiers []string) {
+	d.config.acceptedModifiers = modifierSet(modifiers)
+}
+
+// SetIgnoredModifiers lets you optionally replace the default list of modifiers that have no meaning for DNS filtering, e.g. popup or csp
+// rules with such modifiers are added without them, but are skipped if nothing else is left or SetStrictModifiers is on
+// nil restores the default list, it affects only rules added after the call
+func (d *Dnsfilter) SetIgnoredModifiers(modifiers []string) {
+	if modifiers == nil {
+		d.config.ignoredModifiers = nil
+		return
+	}
+	d.config.ignoredModifiers = modifierSet(modifiers)
+}
+
+func modifierSet(modifiers []string) map[string]bool {
+	set := make(map[string]bool, len(modifiers))
+	for _, modifier := range modifiers {
+		set[strings.ToLower(strings.TrimPrefix(modifier, "$"))] = true
+	}
+	return set
+}
+
+// SetMonitorMode lets you optionally check hosts without filtering them, e.g. to validate a new list against live traffic
+// when it's on, checks that would filter the host are counted in WouldBlock and reported to match hook with the real result, but return a not filtered result
+func (d *Dnsfilter) SetMonitorMode(monitor bool) {
+	d.config.monitorMode = monitor
+}
+
+// SetEnforcedReasons lets you optionally make some reasons advisory, e.g. MaskOf(FilteredBlackList, FilteredSafeBrowsing) to only report parental matches
+// Result.IsFiltered is true only for reasons in mask, while Result.Reason still tells the real reason, zero mask enforces all reasons
+func (d *Dnsfilter) SetEnforcedReasons(mask ReasonMask) {
+	d.config.enforcedReasons = mask
+}
+
+// WouldBlock returns number of checks that would have filtered the host if monitor mode was off
+func (d *Dnsfilter) WouldBlock() uint64 {
+	return atomic.LoadUint64(&d.wouldBlock)
+}
+
+// SetUserAgent lets you optionally change User-Agent header of safebrowsing and parental lookups, empty string resets it to default
+func (d *Dnsfilter) SetUserAgent(userAgent string) {
+	if len(userAgent) == 0 {
+		d.config.userAgent = defaultUserAgent
+	} else {
+		d.config.userAgent = userAgent
+	}
+}
+
+// SetParentalServer lets you optionally change hostname of parental lookup
+func (d *Dnsfilter) SetParentalServer(host string) {
+	if len(host) == 0 {
+		d.config.parentalServer = defaultParentalServer
+	} else {
+		d.config.parentalServer = host
+	}
+}
+
+// SetParentalTransport lets you optionally change HTTP transport used for parental lookups, nil resets it to the one shared with safebrowsing
+func (d *Dnsfilter) SetParentalTransport(transport http.RoundTripper) {
+	d.parentalTransport = transport
+}
+
+// SetSafeBrowsingRateLimit lets you optionally limit number of HTTP requests per second sent to safebrowsing server, 0 removes the limit
+// requests are spaced evenly with no initial burst, so no more than rps of them are sent within any second
+// lookups that can't be done within HTTP timeout fail, and as with other lookup failures, the host is not filtered
+func (d *Dnsfilter) SetSafeBrowsingRateLimit(rps int) {
+	if rps <= 0 {
+		d.safeBrowsingLimit = nil
+		return
+	}
+	d.safeBrowsingLimit = rate.NewLimiter(rate.Limit(rps), 1)
+}
+
+// SetSafeBrowsingHashPrefixLen lets you optionally change length in bytes of hash prefixes sent to safebrowsing server
+// values outside of 1 to 32 range reset it to default of 4
+func (d *Dnsfilter) SetSafeBrowsingHashPrefixLen(length int) {
+	if length <= 0 || length > sha256.Size {
+		d.config.safeBrowsingPrefix = defaultHashPrefixLen
+	} else {
+		d.config.safeBrowsingPrefix = length
+	}
+}
+
+// SetSafeBrowsingCheckDepth lets you optionally limit how many parent domains of the host are checked by safebrowsing, e.g. for deeply nested hosts
+// host itself and depth of its parents closest to the public suffix are checked, so a.b.c.example.org with depth 1 is checked as itself and example.org
+// zero or negative depth checks all parents, which is the default
+func (d *Dnsfilter) SetSafeBrowsingCheckDepth(depth int) {
+	if depth < 0 {
+		depth = 0
+	}
+	d.config.safeBrowsingDepth = depth
+}
+
+// SetBlockedTLDs lets you optionally block all hosts under the given TLDs or other public suffixes, e.g. the ones abused by DGA malware
+// known good domains can be allowed with @@ rules, hosts not matched by any rule are reported as FilteredBlackList with Rule like `*.xyz` and zero RuleID
+// listing uk blocks hosts under co.uk as well, nil or empty list blocks nothing
+func (d *Dnsfilter) SetBlockedTLDs(tlds []string) {
+	if len(tlds) == 0 {
+		d.config.blockedTLDs = nil
+		return
+	}
+	blocked := make(map[string]bool, len(tlds))
+	for _, tld := range tlds {
+		tld = strings.Trim(strings.ToLower(strings.TrimSpace(strings.TrimPrefix(tld, "*"))), ".")
+		if tld != "" {
+			blocked[tld] = true
+		}
+	}
+	d.config.blockedTLDs = blocked
+}
+
+// SetSafeBrowsingExemptClients lets you optionally skip safebrowsing lookups for queries from trusted clients, e.g. admin's laptop
+// clients are matched like in rules with $client option, see CheckHostForClient, so queries without client address are never exempt
+// exempt clients get the verdict of rules and parental only, nil removes all exemptions
+func (d *Dnsfilter) SetSafeBrowsingExemptClients(networks []net.IPNet) {
+	exempt := make([]*net.IPNet, len(networks))
+	for i := range networks {
+		network := networks[i]
+		exempt[i] = &network
+	}
+	d.config.safeBrowsingExempt = exempt
+}
+
+// SetAllowRegexRules lets you optionally disable regex and mask rules for faster matching
+// when disabled, AddRule rejects such rules with ErrRegexRulesDisabled and already added ones are skipped during matching
+func (d *Dnsfilter) SetAllowRegexRules(allow bool) {
+	d.config.regexRulesDisabled = !allow
+	d.invalidateResults()
+}
+
+// SetRegexFullMatch lets you optionally anchor /regex/ rules so that they have to match entire hostname instead of any part of it
+// this changes matching semantics, e.g. /example\.org/ won't match testexample.org anymore
+// it applies only to rules added after the call
+func (d *Dnsfilter) SetRegexFullMatch(fullMatch bool) {
+	d.config.regexFullMatch = fullMatch
+}
+
+// SetMatchHook lets you optionally get notified about every decision made by CheckHost, for example to stream them to a query log
+// hook is called synchronously without holding any locks, so it should be fast; nil disables it
+func (d *Dnsfilter) SetMatchHook(hook func(MatchEvent)) {
+	d.matchHook = hook
+}
+
+// SetSkipLog lets you optionally get notified about every line of a list loaded by LoadRules that wasn't added, along with the reason
+// it's called for invalid and skipped rules, including cosmetic ones, but not for empty lines and comments; nil disables it, which is the default
+func (d *Dnsfilter) SetSkipLog(log func(lineNo int, rule, reason string)) {
+	d.skipLog = log
+}
+
+// SetStrictModifiers lets you optionally reject rules that have modifiers which make sense only in browsers, like $popup
+// by default such modifiers are ignored and the rest of the rule is applied, unless there is nothing left to apply
+// it also makes AddRule return ErrUnknownModifier for rules with unknown modifiers, like $imporant, which are dropped by default
+func (d *Dnsfilter) SetStrictModifiers(strict bool) {
+	d.config.strictModifiers = strict
+}
+
+// SetMaxRules lets you optionally limit number of rules, e.g. to not run out of memory on small devices
+// once there are max rules, AddRule returns ErrRuleLimitExceeded and LoadRules stops, already added rules are kept even if there are more of them
+// zero or negative max removes the limit, which is the default
+func (d *Dnsfilter) SetMaxRules(max int) {
+	if max < 0 {
+		max = 0
+	}
+	d.config.maxRules = max
+}
+
+// SetFilterPriority lets you optionally decide which filter list wins when whitelist and blacklist rules from different lists match the same host
+// filterListIDs are ordered from the most important, lists not mentioned there follow them with lower ID winning
+// $important rules are still checked first; by default, or if filterListIDs is empty, whitelist always wins over blacklist
+func (d *Dnsfilter) SetFilterPriority(filterListIDs []uint32) {
+	defer d.invalidateResults()
+	if len(filterListIDs) == 0 {
+		d.config.filterPriority = nil
+		return
+	}
+	priority := make(map[uint32]int, len(filterListIDs))
+	for i, id := range filterListIDs {
+		if _, ok := priority[id]; !ok {
+			priority[id] = i
+		}
+	}
+	d.config.filterPriority = priority
+}
+
+// FeatureState describes which features are enabled and how they are configured, see Features
+type FeatureState struct {
+	FilteringEnabled    bool
+	SafeBrowsingEnabled bool
+	SafeBrowsingServer  string
+	ParentalEnabled     bool
+	ParentalSensitivity int // set if parental is enabled
+	ParentalServer      string
+	SafeSearchEnabled   bool
+	MonitorMode         bool          // see SetMonitorMode
+	HTTPTimeout         time.Duration // timeout of safebrowsing and parental lookups
+}
+
+// Features returns current state of features toggled with Enable and Disable methods
+func (d *Dnsfilter) Features() FeatureState {
+	state := FeatureState{
+		FilteringEnabled:    !d.isFilteringDisabled(),
+		SafeBrowsingEnabled: isFlagSet(&d.safeBrowsingEnabled),
+		SafeBrowsingServer:  d.config.safeBrowsingServer,
+		ParentalEnabled:     isFlagSet(&d.parentalEnabled),
+		ParentalServer:      d.config.parentalServer,
+		SafeSearchEnabled:   isFlagSet(&d.safeSearchEnabled),
+		MonitorMode:         d.config.monitorMode,
+		HTTPTimeout:         d.httpClient().Timeout,
+	}
+	if state.ParentalEnabled {
+		state.ParentalSensitivity = int(atomic.LoadInt32(&d.parentalSensitivity))
+	}
+	return state
+}
+
+// SetHTTPClient lets you optionally replace http client used for safebrowsing and parental lookups and filter list downloads, e.g. to use a proxy
+// the client is used as is, so SetHTTPTimeout and ResetHTTPTimeout are ignored while it's set, nil restores the internal client
+// parental lookups still use transport set by SetParentalTransport, if any
+func (d *Dnsfilter) SetHTTPClient(client *http.Client) {
+	d.customClient = client
+}
+
+// SetHTTPTimeout lets you optionally change timeout during lookups, it's ignored if SetHTTPClient was called
 func (d *Dnsfilter) SetHTTPTimeout(t time.Duration) {
 	d.client.Timeout = t
 }
 
-// ResetHTTPTimeout resets lookup timeouts
+// ResetHTTPTimeout resets lookup timeouts, it's ignored if SetHTTPClient was called
 func (d *Dnsfilter) ResetHTTPTimeout() {
 	d.client.Timeout = defaultHTTPTimeout
 }
 
 // SafeSearchDomain returns replacement address for search engine
 func (d *Dnsfilter) SafeSearchDomain(host string) (string, bool) {
-	if d.config.safeSearchEnabled {
-		val, ok := safeSearchDomains[host]
-		return val, ok
+	if isFlagSet(&d.safeSearchEnabled) {
+		return d.safeSearchReplacement(normalizeHost(host))
 	}
 	return "", false
 }
@@ -852,12 +2996,97 @@ func (d *Dnsfilter) SafeSearchDomain(host string) (string, bool) {
 // stats
 //
 
-// GetStats return dns filtering stats since startup
+// GetStats return dns filtering stats since startup, same as StatsSnapshot
 func (d *Dnsfilter) GetStats() Stats {
-	return stats
+	return d.StatsSnapshot()
+}
+
+// StatsSnapshot returns a copy of dns filtering stats since startup, every counter is read atomically so it's safe to call during lookups
+func (d *Dnsfilter) StatsSnapshot() Stats {
+	return Stats{
+		Safebrowsing: stats.Safebrowsing.snapshot(),
+		Parental:     stats.Parental.snapshot(),
+	}
+}
+
+func (s *LookupStats) snapshot() LookupStats {
+	return LookupStats{
+		Requests:   atomic.LoadUint64(&s.Requests),
+		CacheHits:  atomic.LoadUint64(&s.CacheHits),
+		Pending:    atomic.LoadInt64(&s.Pending),
+		PendingMax: atomic.LoadInt64(&s.PendingMax),
+	}
+}
+
+// RegexStats returns number of rules that need regexp matching and total length of their patterns
+func (d *Dnsfilter) RegexStats() (count int, totalPatternBytes int) {
+	return int(atomic.LoadInt64(&d.regexCount)), int(atomic.LoadInt64(&d.regexBytes))
+}
+
+// Rules returns copies of rules added with specified filter list ID, sorted by rule ID
+// filterListID of -1 returns rules from all filter lists
+func (d *Dnsfilter) Rules(filterListID int) []RuleInfo {
+	d.storageMutex.RLock()
+	defer d.storageMutex.RUnlock()
+	rules := []RuleInfo{}
+	for _, rule := range d.rulesByID {
+		if filterListID >= 0 && uint32(filterListID) != rule.listID {
+			continue
+		}
+		rules = append(rules, rule.info())
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].ID < rules[j].ID })
+	return rules
+}
+
+// info returns description of the rule for applications
+func (rule *rule) info() RuleInfo {
+	info := RuleInfo{
+		ID:           rule.id,
+		FilterListID: rule.listID,
+		Text:         rule.originalText,
+		IsWhitelist:  rule.isWhitelist,
+		IsImportant:  rule.isImportant,
+		IsRegexp:     rule.needsRegexp(),
+		Enabled:      !rule.isDisabled(),
+		Comment:      rule.comment,
+		Hits:         atomic.LoadUint64(&rule.hits),
+	}
+	if info.IsRegexp {
+		info.Pattern, _ = rule.pattern()
+	}
+	return info
+}
+
+// GetRule returns rule with exactly the same text as it was added with, false if there is no such rule
+// surrounding whitespace is ignored, as it is by AddRule
+func (d *Dnsfilter) GetRule(text string) (RuleInfo, bool) {
+	d.storageMutex.RLock()
+	defer d.storageMutex.RUnlock()
+	rule, ok := d.storage[strings.TrimSpace(text)]
+	if !ok {
+		return RuleInfo{}, false
+	}
+	return rule.info(), true
 }
 
 // Count returns number of rules added to filter
 func (d *Dnsfilter) Count() int {
 	return len(d.storage)
 }
+
+// WhitelistCount returns number of added rules that start with @@, including $important ones, but not $badfilter ones
+func (d *Dnsfilter) WhitelistCount() int {
+	return int(atomic.LoadInt64(&d.whitelistCount))
+}
+
+// BlacklistCount returns number of added rules that are neither whitelist nor $badfilter rules
+// together with WhitelistCount and BadfilterCount it adds up to Count
+func (d *Dnsfilter) BlacklistCount() int {
+	return int(atomic.LoadInt64(&d.blacklistCount))
+}
+
+// BadfilterCount returns number of added $badfilter rules, which only disable other rules
+func (d *Dnsfilter) BadfilterCount() int {
+	return int(atomic.LoadInt64(&d.badfilterCount))
+}
@@ -3,12 +3,22 @@ package dnsfilter
 import (
 	"archive/zip"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"expvar"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"path"
+	"reflect"
+	"regexp"
 	"runtime/pprof"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -198,7 +208,7 @@ func TestRuleToRegexp(t *testing.T) {
 		{`||doubleclick.net^`, `(?:^|\.)doubleclick\.net$`, nil},
 	}
 	for _, testcase := range tests {
-		converted, err := ruleToRegexp(testcase.rule)
+		converted, err := ruleToRegexp(testcase.rule, "")
 		if err != testcase.err {
 			t.Error("Errors do not match, got ", err, " expected ", testcase.err)
 		}
@@ -323,6 +333,60 @@ func mustLoadTestRules(d *Dnsfilter) {
 	}
 }
 
+// safeBrowsingTestServer speaks safebrowsing protocol and reports specified hosts as malicious after a delay
+func safeBrowsingTestServer(delay time.Duration, blocked ...string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		for _, host := range blocked {
+			sum := sha256.Sum256([]byte(host + "/"))
+			fmt.Fprintf(w, "adguard-malware-shavar:1:%X\n", sum)
+		}
+	}))
+}
+
+// safeBrowsingJSONTestServer speaks SafeBrowsingJSON protocol and reports specified hosts as phishing
+func safeBrowsingJSONTestServer(blocked ...string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/safebrowsing-lookup-hash.json" {
+			http.NotFound(w, r)
+			return
+		}
+		prefixes := map[string]bool{}
+		for _, prefix := range strings.Split(r.URL.Query().Get("prefixes"), "/") {
+			prefixes[prefix] = true
+		}
+		type entry struct {
+			Hash string `json:"hash"`
+			List string `json:"list"`
+		}
+		entries := []entry{}
+		for _, host := range blocked {
+			hash := fmt.Sprintf("%X", sha256.Sum256([]byte(host+"/")))
+			if prefixes[hash[:2*defaultHashPrefixLen]] {
+				entries = append(entries, entry{Hash: hash, List: "adguard-phishing-shavar"})
+			}
+		}
+		json.NewEncoder(w).Encode(entries)
+	}))
+}
+
+// parentalTestServer speaks parental control protocol and reports specified hosts as adult
+func parentalTestServer(blocked ...string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		type entry struct {
+			Blocked bool   `json:"blocked"`
+			Reason  string `json:"reason"`
+			Hash    string `json:"hash"`
+		}
+		entries := []entry{}
+		for _, host := range blocked {
+			sum := sha256.Sum256([]byte(host))
+			entries = append(entries, entry{Blocked: true, Reason: "PORN", Hash: fmt.Sprintf("%X", sum)})
+		}
+		json.NewEncoder(w).Encode(entries)
+	}))
+}
+
 func NewForTest() *Dnsfilter {
 	d := New()
 	purgeCaches()
@@ -404,210 +468,4004 @@ func TestSuffixMatching6(t *testing.T) {
 	d := NewForTest()
 	defer d.Destroy()
 
-	d.checkAddRule(t, "||*doubleclick.net^")
+	d.checkAddRule(t, "||*doubleclick.net^")
+	d.checkMatch(t, "doubleclick.net")
+	d.checkMatch(t, "www.doubleclick.net")
+	d.checkMatch(t, "nodoubleclick.net")
+	d.checkMatchEmpty(t, "doubleclick.net.ru")
+}
+
+func TestCount(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	err := loadTestRules(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := d.Count()
+	expected := 12747
+	if count != expected {
+		t.Fatalf("Number of rules parsed should be %d, but it is %d\n", expected, count)
+	}
+}
+
+func TestDnsFilterBlocking(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.checkAddRule(t, "||example.org^")
+
+	d.checkMatch(t, "example.org")
+	d.checkMatch(t, "test.example.org")
+	d.checkMatch(t, "test.test.example.org")
+	d.checkMatchEmpty(t, "testexample.org")
+	d.checkMatchEmpty(t, "onemoreexample.org")
+}
+
+func TestDnsFilterWhitelist(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.checkAddRule(t, "||example.org^")
+	d.checkAddRule(t, "@@||test.example.org")
+
+	d.checkMatch(t, "example.org")
+	d.checkMatchEmpty(t, "test.example.org")
+	d.checkMatchEmpty(t, "test.test.example.org")
+}
+
+func TestDnsFilterImportant(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.checkAddRule(t, "@@||example.org^")
+	d.checkAddRule(t, "||test.example.org^$important")
+
+	d.checkMatchEmpty(t, "example.org")
+	d.checkMatch(t, "test.example.org")
+	d.checkMatch(t, "test.test.example.org")
+	d.checkMatchEmpty(t, "testexample.org")
+	d.checkMatchEmpty(t, "onemoreexample.org")
+}
+
+func TestDnsFilterRegexrule(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.checkAddRule(t, "/example\\.org/")
+	d.checkAddRule(t, "@@||test.example.org^")
+
+	d.checkMatch(t, "example.org")
+	d.checkMatchEmpty(t, "test.example.org")
+	d.checkMatchEmpty(t, "test.test.example.org")
+	d.checkMatch(t, "testexample.org")
+	d.checkMatch(t, "onemoreexample.org")
+}
+
+func TestDomainMask(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.checkAddRule(t, "test*.example.org^")
+	d.checkAddRule(t, "exam*.com")
+
+	d.checkMatch(t, "test.example.org")
+	d.checkMatch(t, "test2.example.org")
+	d.checkMatch(t, "example.com")
+	d.checkMatch(t, "exampleeee.com")
+
+	d.checkMatchEmpty(t, "example.org")
+	d.checkMatchEmpty(t, "testexample.org")
+	d.checkMatchEmpty(t, "example.co.uk")
+}
+
+func TestRulePattern(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.checkAddRule(t, "test*.example.org^")
+	d.checkAddRule(t, "||example.org^")
+
+	info, ok := d.GetRule("test*.example.org^")
+	if !ok || !info.IsRegexp {
+		t.Fatalf("expected mask rule to need regexp, got %+v", info)
+	}
+	if info.Pattern != `test.*\.example\.org$` {
+		t.Errorf("unexpected pattern %q", info.Pattern)
+	}
+	pattern := regexp.MustCompile(info.Pattern)
+	if !pattern.MatchString("test2.example.org") || pattern.MatchString("example.org") {
+		t.Errorf("pattern %q must match test2.example.org only", info.Pattern)
+	}
+	info, _ = d.GetRule("||example.org^")
+	if info.Pattern != "" {
+		t.Errorf("expected no pattern for domain rule, got %q", info.Pattern)
+	}
+}
+
+func TestAddRuleFail(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.checkAddRuleFail(t, "lkfaojewhoawehfwacoefawr$@#$@3413841384")
+}
+
+func TestSafeBrowsing(t *testing.T) {
+	testCases := []string{
+		"",
+		"sb.adtidy.org",
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%s in %s", tc, _Func()), func(t *testing.T) {
+			d := NewForTest()
+			defer d.Destroy()
+			d.EnableSafeBrowsing()
+			atomic.StoreUint64(&stats.Safebrowsing.Requests, 0)
+			d.checkMatch(t, "wmconvirus.narod.ru")
+			d.checkMatch(t, "wmconvirus.narod.ru")
+			if d.StatsSnapshot().Safebrowsing.Requests != 1 {
+				t.Errorf("Safebrowsing lookup positive cache is not working: %v", d.StatsSnapshot().Safebrowsing.Requests)
+			}
+			d.checkMatch(t, "WMconvirus.narod.ru")
+			if d.StatsSnapshot().Safebrowsing.Requests != 1 {
+				t.Errorf("Safebrowsing lookup positive cache is not working: %v", d.StatsSnapshot().Safebrowsing.Requests)
+			}
+			d.checkMatch(t, "wmconvirus.narod.ru.")
+			d.checkMatch(t, "test.wmconvirus.narod.ru")
+			d.checkMatch(t, "test.wmconvirus.narod.ru.")
+			d.checkMatchEmpty(t, "yandex.ru")
+			d.checkMatchEmpty(t, "pornhub.com")
+			l := d.StatsSnapshot().Safebrowsing.Requests
+			d.checkMatchEmpty(t, "pornhub.com")
+			if d.StatsSnapshot().Safebrowsing.Requests != l {
+				t.Errorf("Safebrowsing lookup negative cache is not working: %v", d.StatsSnapshot().Safebrowsing.Requests)
+			}
+		})
+	}
+}
+
+func TestParallelSB(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.EnableSafeBrowsing()
+	t.Run("group", func(t *testing.T) {
+		for i := 0; i < 100; i++ {
+			t.Run(fmt.Sprintf("aaa%d", i), func(t *testing.T) {
+				t.Parallel()
+				d.checkMatch(t, "wmconvirus.narod.ru")
+				d.checkMatch(t, "wmconvirus.narod.ru.")
+				d.checkMatch(t, "test.wmconvirus.narod.ru")
+				d.checkMatch(t, "test.wmconvirus.narod.ru.")
+				d.checkMatchEmpty(t, "yandex.ru")
+				d.checkMatchEmpty(t, "pornhub.com")
+			})
+		}
+	})
+}
+
+// the only way to verify that custom server option is working is to point it at a server that does serve safebrowsing
+func TestSafeBrowsingCustomServerFail(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// w.Write("Hello, client")
+		fmt.Fprintln(w, "Hello, client")
+	}))
+	defer ts.Close()
+	address := ts.Listener.Addr().String()
+
+	d.EnableSafeBrowsing()
+	d.SetHTTPTimeout(time.Second * 5)
+	d.SetSafeBrowsingServer(address) // this will ensure that test fails
+	d.checkMatchEmpty(t, "wmconvirus.narod.ru")
+}
+
+func TestParentalControl(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.EnableParental(3)
+	d.checkMatch(t, "pornhub.com")
+	d.checkMatch(t, "pornhub.com")
+	if d.StatsSnapshot().Parental.Requests != 1 {
+		t.Errorf("Parental lookup positive cache is not working")
+	}
+	d.checkMatch(t, "PORNhub.com")
+	if d.StatsSnapshot().Parental.Requests != 1 {
+		t.Errorf("Parental lookup positive cache is not working")
+	}
+	d.checkMatch(t, "www.pornhub.com")
+	d.checkMatch(t, "pornhub.com.")
+	d.checkMatch(t, "www.pornhub.com.")
+	d.checkMatchEmpty(t, "www.yandex.ru")
+	d.checkMatchEmpty(t, "yandex.ru")
+	l := d.StatsSnapshot().Parental.Requests
+	d.checkMatchEmpty(t, "yandex.ru")
+	if d.StatsSnapshot().Parental.Requests != l {
+		t.Errorf("Parental lookup negative cache is not working")
+	}
+
+	d.checkMatchEmpty(t, "api.jquery.com")
+}
+
+func TestDestroyDuringLookups(t *testing.T) {
+	ts := safeBrowsingTestServer(50*time.Millisecond, "wmconvirus.narod.ru")
+	defer ts.Close()
+	d := NewForTest()
+	d.EnableSafeBrowsing()
+	d.SetSafeBrowsingServer(ts.Listener.Addr().String())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := d.CheckHost(fmt.Sprintf("host%d.narod.ru", i%5))
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	time.Sleep(10 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.Destroy()
+		}()
+	}
+	wg.Wait()
+
+	// no lookups after Destroy
+	before := d.StatsSnapshot().Safebrowsing.Requests
+	d.checkMatchEmpty(t, "wmconvirus.narod.ru")
+	if after := d.StatsSnapshot().Safebrowsing.Requests; after != before {
+		t.Errorf("expected no lookups after Destroy, got %d", after-before)
+	}
+	d.Destroy()
+}
+
+func TestLookupsNotSharedBetweenInstances(t *testing.T) {
+	var agents sync.Map
+	sb := safeBrowsingTestServer(50*time.Millisecond, "wmconvirus.narod.ru")
+	defer sb.Close()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agents.Store(r.UserAgent(), true)
+		sb.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	var wg sync.WaitGroup
+	for _, agent := range []string{"first", "second"} {
+		d := NewForTest()
+		defer d.Destroy()
+		d.EnableSafeBrowsing()
+		d.SetSafeBrowsingServer(ts.Listener.Addr().String())
+		d.SetUserAgent(agent)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.checkMatch(t, "wmconvirus.narod.ru")
+		}()
+	}
+	wg.Wait()
+
+	// same URL, but each instance does its own request
+	for _, agent := range []string{"first", "second"} {
+		if _, ok := agents.Load(agent); !ok {
+			t.Errorf("expected request with user agent %s", agent)
+		}
+	}
+}
+
+func TestDestroyAbortsLookups(t *testing.T) {
+	// server hangs until the client goes away
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+	d := NewForTest()
+	d.EnableSafeBrowsing()
+	d.SetSafeBrowsingServer(ts.Listener.Addr().String())
+	d.SetHTTPTimeout(time.Minute)
+
+	done := make(chan Result)
+	go func() {
+		ret, _ := d.CheckHost("wmconvirus.narod.ru")
+		done <- ret
+	}()
+	for d.StatsSnapshot().Safebrowsing.Pending == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	destroyed := make(chan struct{})
+	go func() {
+		d.Destroy()
+		close(destroyed)
+	}()
+	select {
+	case <-destroyed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Destroy waited for in-flight lookup")
+	}
+	select {
+	case ret := <-done:
+		if ret.IsFiltered {
+			t.Errorf("expected aborted lookup not to filter, got %v", ret.Reason)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("in-flight lookup wasn't aborted by Destroy")
+	}
+}
+
+func TestSafeSearch(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	_, ok := d.SafeSearchDomain("www.google.com")
+	if ok {
+		t.Errorf("Expected safesearch to error when disabled")
+	}
+	d.EnableSafeSearch()
+	val, ok := d.SafeSearchDomain("www.google.com")
+	if !ok {
+		t.Errorf("Expected safesearch to find result for www.google.com")
+	}
+	if val != "forcesafesearch.google.com" {
+		t.Errorf("Expected safesearch for google.com to be forcesafesearch.google.com")
+	}
+}
+
+func TestExportRulesRoundTrip(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	lists := map[uint32][]string{
+		1: {"||example.org^", "@@||test.example.org^"},
+		2: {"||doubleclick.net^", "/example\\.com/", "test*.example.net^"},
+		5: {"||example.ru^$important"},
+	}
+	for id, rules := range lists {
+		for _, rule := range rules {
+			err := d.AddRule(rule, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	err := d.ExportRules(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d2 := NewForTest()
+	defer d2.Destroy()
+	added, err := d2.LoadRulesFromReader(&buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != d.Count() {
+		t.Errorf("Expected %d rules to be loaded, got %d", d.Count(), added)
+	}
+	for id, rules := range lists {
+		if count := d2.CountByFilter(id); count != len(rules) {
+			t.Errorf("Filter %d should have %d rules after reload, but it has %d", id, len(rules), count)
+		}
+	}
+	if count := d2.CountByFilter(0); count != 0 {
+		t.Errorf("Filter 0 should be empty after reload, but it has %d rules", count)
+	}
+}
+
+func TestDisallowRegexRules(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.SetAllowRegexRules(false)
+
+	for _, rule := range []string{"/example\\.org/", "test*.example.org^", "exam*.com", "|doubleclick.net^"} {
+		err := d.AddRule(rule, 0)
+		if err != ErrRegexRulesDisabled {
+			t.Errorf("Adding rule %s should have failed with %v, got %v", rule, ErrRegexRulesDisabled, err)
+		}
+	}
+	if d.Count() != 0 {
+		t.Errorf("Expected no rules to be added, got %d", d.Count())
+	}
+
+	added, err := d.LoadRulesFromReader(strings.NewReader("/example\\.org/\n/doubleclick/\n"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 0 || d.Count() != 0 {
+		t.Errorf("Expected regex-only list to add no rules, got %d", d.Count())
+	}
+
+	d.checkAddRule(t, "||example.org^")
+	d.checkMatch(t, "test.example.org")
+	d.checkMatchEmpty(t, "testexample.org")
+}
+
+func TestDisallowRegexRulesSkipsAdded(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.checkAddRule(t, "/example\\.org/")
+	d.checkMatch(t, "testexample.org")
+
+	d.SetAllowRegexRules(false)
+	d.checkMatchEmpty(t, "testexample.org")
+}
+
+func TestRegexStats(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.checkAddRule(t, "||example.org^")
+	d.checkAddRule(t, "@@||test.example.org^")
+	count, size := d.RegexStats()
+	if count != 0 || size != 0 {
+		t.Errorf("Expected no regex rules, got %d rules with %d bytes", count, size)
+	}
+
+	d.checkAddRule(t, "/example\\.org/") // example\.org
+	d.checkAddRule(t, "exam*.com")       // exam.*\.com
+	count, size = d.RegexStats()
+	if count != 2 || size != 23 {
+		t.Errorf("Expected 2 regex rules with 23 bytes, got %d rules with %d bytes", count, size)
+	}
+}
+
+func TestDNSClassRule(t *testing.T) {
+	const classCHAOS = 3
+	d := NewForTest()
+	defer d.Destroy()
+	d.checkAddRule(t, "||version.bind^$dnsclass=CH")
+	d.checkAddRuleFail(t, "||example.org^$dnsclass=XX")
+
+	ret, err := d.CheckHostClass("version.bind", classCHAOS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ret.IsFiltered {
+		t.Errorf("Expected CHAOS query for version.bind to be filtered")
+	}
+	d.checkMatchEmpty(t, "version.bind")
+	ret, err = d.CheckHostClass("version.bind", classINET)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret.IsFiltered {
+		t.Errorf("Expected IN query for version.bind to not be filtered")
+	}
+}
+
+func TestRuleIDs(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	id1, err := d.AddRuleID("||example.org^", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, err := d.AddRuleID("||doubleclick.net^", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id1 == 0 || id2 <= id1 {
+		t.Errorf("Expected increasing non-zero rule IDs, got %d and %d", id1, id2)
+	}
+
+	ret, err := d.CheckHost("www.example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret.RuleID != id1 {
+		t.Errorf("Expected result to have rule ID %d, got %d", id1, ret.RuleID)
+	}
+
+	if !d.DisableRuleByID(id2) {
+		t.Fatalf("Failed to disable rule %d", id2)
+	}
+	d.checkMatchEmpty(t, "doubleclick.net")
+	if !d.EnableRuleByID(id2) {
+		t.Fatalf("Failed to enable rule %d", id2)
+	}
+	d.checkMatch(t, "doubleclick.net")
+
+	if !d.RemoveRuleByID(id1) {
+		t.Fatalf("Failed to remove rule %d", id1)
+	}
+	if d.RemoveRuleByID(id1) {
+		t.Errorf("Rule %d should have been already removed", id1)
+	}
+	d.checkMatchEmpty(t, "www.example.org")
+	if d.Count() != 1 {
+		t.Errorf("Expected one rule to remain, got %d", d.Count())
+	}
+
+	// removed rule can be added again
+	d.checkAddRule(t, "||example.org^")
+	d.checkMatch(t, "www.example.org")
+}
+
+func TestSafeBrowsingCoalescing(t *testing.T) {
+	ts := safeBrowsingTestServer(100*time.Millisecond, "wmconvirus.narod.ru")
+	defer ts.Close()
+	d := NewForTest()
+	defer d.Destroy()
+	d.EnableSafeBrowsing()
+	d.SetSafeBrowsingServer(ts.Listener.Addr().String())
+
+	before := d.StatsSnapshot().Safebrowsing.Requests
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.checkMatch(t, "wmconvirus.narod.ru")
+		}()
+	}
+	wg.Wait()
+	requests := d.StatsSnapshot().Safebrowsing.Requests - before
+	if requests != 1 {
+		t.Errorf("Expected concurrent lookups to share one request, got %d requests", requests)
+	}
+}
+
+func TestSafeBrowsingHashPrefixLen(t *testing.T) {
+	const host = "wmconvirus.narod.ru"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, prefix := range strings.Split(strings.Trim(r.URL.Query().Get("prefixes"), "/"), "/") {
+			if len(prefix) != 2*2 {
+				t.Errorf("Expected 2 bytes long hash prefix, got %s", prefix)
+				return
+			}
+		}
+		sum := sha256.Sum256([]byte(host + "/"))
+		fmt.Fprintf(w, "adguard-malware-shavar:1:%X\n", sum)
+	}))
+	defer ts.Close()
+	d := NewForTest()
+	defer d.Destroy()
+	d.EnableSafeBrowsing()
+	d.SetSafeBrowsingServer(ts.Listener.Addr().String())
+	d.SetSafeBrowsingHashPrefixLen(2)
+	d.checkMatch(t, host)
+	d.checkMatch(t, "test."+host)
+}
+
+func TestBlockedTLDs(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.SetBlockedTLDs([]string{"xyz", ".TOP", "*.uk"})
+	d.checkAddRule(t, "@@||good.xyz^")
+	d.checkAddRule(t, "||example.org^")
+
+	ret, err := d.CheckHost("qwkjhz.xyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ret.IsFiltered || ret.Reason != FilteredBlackList || ret.Rule != "*.xyz" || ret.RuleID != 0 {
+		t.Errorf("expected host to be blocked by TLD, got %+v", ret)
+	}
+	d.checkMatch(t, "sub.random.top")
+	d.checkMatch(t, "ads.co.uk")
+	d.checkMatch(t, "example.org")
+	d.checkMatchEmpty(t, "good.xyz")
+	d.checkMatchEmpty(t, "www.good.xyz")
+	d.checkMatchEmpty(t, "example.com")
+	d.checkMatchEmpty(t, "xyz")
+
+	d.SetBlockedTLDs(nil)
+	d.checkMatchEmpty(t, "qwkjhz.xyz")
+}
+
+func TestSafeBrowsingExemptClients(t *testing.T) {
+	var requests int32
+	sb := safeBrowsingTestServer(0, "wmconvirus.narod.ru")
+	defer sb.Close()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		sb.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	d := NewForTest()
+	defer d.Destroy()
+	d.EnableSafeBrowsing()
+	d.SetSafeBrowsingServer(ts.Listener.Addr().String())
+	_, admins, _ := net.ParseCIDR("192.168.1.0/24")
+	d.SetSafeBrowsingExemptClients([]net.IPNet{*admins})
+
+	ret, err := d.CheckHostForClient("wmconvirus.narod.ru", net.ParseIP("192.168.1.5"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret.IsFiltered {
+		t.Errorf("expected exempt client not to be filtered, got %v", ret.Reason)
+	}
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Errorf("expected no safebrowsing requests for exempt client, got %d", n)
+	}
+
+	ret, err = d.CheckHostForClient("wmconvirus.narod.ru", net.ParseIP("10.0.0.5"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret.Reason != FilteredSafeBrowsing {
+		t.Errorf("expected other client to be filtered by safebrowsing, got %v", ret.Reason)
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("expected one safebrowsing request, got %d", n)
+	}
+}
+
+func TestSafeBrowsingCheckDepth(t *testing.T) {
+	var (
+		mutex    sync.Mutex
+		prefixes []string
+	)
+	sb := safeBrowsingTestServer(0, "wmconvirus.narod.ru")
+	defer sb.Close()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		prefixes = strings.Split(strings.TrimSuffix(r.URL.Query().Get("prefixes"), "/"), "/")
+		mutex.Unlock()
+		sb.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	d := NewForTest()
+	defer d.Destroy()
+	d.EnableSafeBrowsing()
+	d.SetSafeBrowsingServer(ts.Listener.Addr().String())
+	prefixOf := func(host string) string {
+		return fmt.Sprintf("%X", sha256.Sum256([]byte(host+"/")))[:2*defaultHashPrefixLen]
+	}
+
+	// a.b.c.wmconvirus.narod.ru has 6 labels, all levels but TLD are checked by default
+	d.checkMatch(t, "a.b.c.wmconvirus.narod.ru")
+	if len(prefixes) != 5 {
+		t.Errorf("expected 5 hash prefixes, got %v", prefixes)
+	}
+
+	purgeCaches()
+	d.SetSafeBrowsingCheckDepth(2)
+	d.checkMatch(t, "a.b.c.wmconvirus.narod.ru")
+	expected := []string{prefixOf("a.b.c.wmconvirus.narod.ru"), prefixOf("wmconvirus.narod.ru"), prefixOf("narod.ru")}
+	if !reflect.DeepEqual(prefixes, expected) {
+		t.Errorf("expected hash prefixes %v, got %v", expected, prefixes)
+	}
+
+	purgeCaches()
+	d.SetSafeBrowsingCheckDepth(1)
+	d.checkMatchEmpty(t, "a.b.c.wmconvirus.narod.ru")
+	if len(prefixes) != 2 || prefixes[1] != prefixOf("narod.ru") {
+		t.Errorf("expected host and narod.ru to be checked, got %v", prefixes)
+	}
+}
+
+func TestRules(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	id1, err := d.AddRuleID("||example.org^", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, err := d.AddRuleID("@@/example\\.com/", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.DisableRuleByID(id2)
+
+	all := d.Rules(-1)
+	if len(all) != 2 {
+		t.Fatalf("Expected 2 rules, got %d", len(all))
+	}
+	rules := d.Rules(2)
+	if len(rules) != 1 {
+		t.Fatalf("Expected 1 rule in filter 2, got %d", len(rules))
+	}
+	expected := RuleInfo{ID: id2, FilterListID: 2, Text: "@@/example\\.com/", IsWhitelist: true, IsRegexp: true, Enabled: false, Pattern: "example\\.com"}
+	if rules[0] != expected {
+		t.Errorf("Expected %+v, got %+v", expected, rules[0])
+	}
+	if all[0].ID != id1 || !all[0].Enabled || all[0].IsRegexp {
+		t.Errorf("Unexpected info for rule %d: %+v", id1, all[0])
+	}
+
+	// returned rules are copies
+	all[0].Text = "changed"
+	if d.Rules(1)[0].Text != "||example.org^" {
+		t.Errorf("Rules must return copies of internal state")
+	}
+	if len(d.Rules(3)) != 0 {
+		t.Errorf("Expected no rules in filter 3")
+	}
+}
+
+func TestExactMatchRule(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.checkAddRule(t, "|example.com|")
+
+	d.checkMatch(t, "example.com")
+	d.checkMatch(t, "example.com.")
+	d.checkMatch(t, "EXAMPLE.com")
+	d.checkMatchEmpty(t, "www.example.com")
+	d.checkMatchEmpty(t, "notexample.com")
+	d.checkMatchEmpty(t, "example.com.ru")
+	d.checkMatchEmpty(t, "example.co")
+}
+
+func TestRuleComment(t *testing.T) {
+	const comment = "added per ticket 42"
+	d := NewForTest()
+	defer d.Destroy()
+	err := d.AddRuleWithComment("||ads.com^", 0, comment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.checkAddRule(t, "||example.org^")
+
+	ret, err := d.CheckHost("www.ads.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ret.IsFiltered || ret.Comment != comment {
+		t.Errorf("Expected filtered result with comment %q, got %+v", comment, ret)
+	}
+	ret, err = d.CheckHost("example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret.Comment != "" {
+		t.Errorf("Expected no comment for rule without one, got %q", ret.Comment)
+	}
+	if rules := d.Rules(0); rules[0].Comment != comment {
+		t.Errorf("Expected Rules to report comment %q, got %q", comment, rules[0].Comment)
+	}
+}
+
+func TestCheckIP(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.checkAddRule(t, "||192.168.1.0/24^")
+	d.checkAddRule(t, "@@||192.168.1.128/25^")
+	d.checkAddRule(t, "||2001:db8::/32^")
+
+	for _, testcase := range []struct {
+		ip     string
+		reason Reason
+	}{
+		{"192.168.1.1", FilteredBlackList},
+		{"192.168.1.200", NotFilteredWhiteList},
+		{"192.168.2.1", NotFilteredNotFound},
+		{"2001:db8::1", FilteredBlackList},
+		{"2001:db9::1", NotFilteredNotFound},
+	} {
+		ret, err := d.CheckIP(net.ParseIP(testcase.ip))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ret.Reason != testcase.reason {
+			t.Errorf("IP %s has wrong reason (%v must be %v)", testcase.ip, ret.Reason, testcase.reason)
+		}
+	}
+	ret, _ := d.CheckIP(net.ParseIP("192.168.1.1"))
+	if ret.Rule != "||192.168.1.0/24^" {
+		t.Errorf("Expected matching network rule to be reported, got %q", ret.Rule)
+	}
+
+	// network rules are not used for hostnames
+	d.checkMatchEmpty(t, "192.168.1.1")
+}
+
+func TestDisableFeatures(t *testing.T) {
+	sb := safeBrowsingTestServer(0, "wmconvirus.narod.ru")
+	defer sb.Close()
+	pc := parentalTestServer("pornhub.com")
+	defer pc.Close()
+	d := NewForTest()
+	defer d.Destroy()
+	d.SetSafeBrowsingServer(sb.Listener.Addr().String())
+	d.SetParentalServer(pc.Listener.Addr().String())
+
+	d.EnableSafeBrowsing()
+	d.checkMatch(t, "wmconvirus.narod.ru")
+	d.DisableSafeBrowsing()
+	requests := d.StatsSnapshot().Safebrowsing.Requests
+	d.checkMatchEmpty(t, "wmconvirus.narod.ru")
+	d.checkMatchEmpty(t, "test.wmconvirus.narod.ru")
+	if d.StatsSnapshot().Safebrowsing.Requests != requests {
+		t.Errorf("Safebrowsing lookups must not be done when it is disabled")
+	}
+
+	err := d.EnableParental(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.checkMatch(t, "pornhub.com")
+	d.DisableParental()
+	requests = d.StatsSnapshot().Parental.Requests
+	d.checkMatchEmpty(t, "pornhub.com")
+	d.checkMatchEmpty(t, "www.pornhub.com")
+	if d.StatsSnapshot().Parental.Requests != requests {
+		t.Errorf("Parental lookups must not be done when it is disabled")
+	}
+
+	d.EnableSafeSearch()
+	if _, ok := d.SafeSearchDomain("www.google.com"); !ok {
+		t.Errorf("Expected safesearch to find result for www.google.com")
+	}
+	d.DisableSafeSearch()
+	if _, ok := d.SafeSearchDomain("www.google.com"); ok {
+		t.Errorf("Expected safesearch to not find result when disabled")
+	}
+}
+
+func TestSetEnabled(t *testing.T) {
+	ts := safeBrowsingTestServer(0, "wmconvirus.narod.ru")
+	defer ts.Close()
+	d := NewForTest()
+	defer d.Destroy()
+	d.EnableSafeBrowsing()
+	d.SetSafeBrowsingServer(ts.Listener.Addr().String())
+	d.checkAddRule(t, "||example.org^")
+	d.checkMatch(t, "example.org")
+
+	d.SetEnabled(false)
+	requests := d.StatsSnapshot().Safebrowsing.Requests
+	d.checkMatchEmpty(t, "example.org")
+	d.checkMatchEmpty(t, "wmconvirus.narod.ru")
+	if d.StatsSnapshot().Safebrowsing.Requests != requests {
+		t.Errorf("Safebrowsing lookups must not be done when filtering is disabled")
+	}
+	if d.Count() != 1 {
+		t.Errorf("Rules must be kept when filtering is disabled")
+	}
+
+	d.SetEnabled(true)
+	d.checkMatch(t, "example.org")
+	d.checkMatch(t, "wmconvirus.narod.ru")
+}
+
+func TestSetEnabledConcurrent(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.checkAddRule(t, "||example.org^")
+
+	stop := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if _, err := d.CheckHost("example.org"); err != nil {
+					t.Error(err)
+					return
+				}
+				d.CheckIP(net.ParseIP("192.168.0.1"))
+				d.Features()
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		d.SetEnabled(i%2 == 1)
+	}
+	close(stop)
+	wg.Wait()
+
+	d.checkMatch(t, "example.org")
+	d.SetEnabled(false)
+	d.checkMatchEmpty(t, "example.org")
+	if d.Clone().Features().FilteringEnabled {
+		t.Errorf("expected clone to keep filtering disabled")
+	}
+}
+
+func TestFeatureTogglesConcurrent(t *testing.T) {
+	ts := safeBrowsingTestServer(0, "wmconvirus.narod.ru")
+	defer ts.Close()
+	d := NewForTest()
+	defer d.Destroy()
+	d.SetSafeBrowsingServer(ts.Listener.Addr().String())
+	d.SetParentalServer(ts.Listener.Addr().String())
+
+	stop := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				d.CheckHost("wmconvirus.narod.ru")
+				d.SafeSearchDomain("www.google.com")
+				d.WouldLookup("example.org")
+				d.Features()
+			}
+		}()
+	}
+	for i := 0; i < 50; i++ {
+		d.EnableSafeBrowsing()
+		d.EnableParental(13)
+		d.EnableSafeSearch()
+		d.DisableSafeBrowsing()
+		d.DisableParental()
+		d.DisableSafeSearch()
+	}
+	close(stop)
+	wg.Wait()
+
+	features := d.Features()
+	if features.SafeBrowsingEnabled || features.ParentalEnabled || features.SafeSearchEnabled {
+		t.Errorf("expected all features to be disabled, got %+v", features)
+	}
+}
+
+func TestCacheEvictionPolicy(t *testing.T) {
+	for _, testcase := range []struct {
+		policy   CacheEvictionPolicy
+		survives bool
+	}{
+		{CacheEvictionLRU, false},
+		{CacheEvictionLFU, true},
+	} {
+		cache := newLookupCache(testcase.policy, 10)
+		hot := Result{IsFiltered: true, Reason: FilteredSafeBrowsing}
+		cache.Set("hot.example.org", hot)
+		for i := 0; i < 100; i++ {
+			cache.Get("hot.example.org")
+		}
+		// flood of one-off clean lookups
+		for i := 0; i < 100; i++ {
+			cache.Set(fmt.Sprintf("host%d.example.org", i), Result{})
+		}
+		_, survived, err := getCachedReason(cache, "hot.example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if survived != testcase.survives {
+			t.Errorf("Policy %d: expected frequently used entry to survive eviction: %v, got %v", testcase.policy, testcase.survives, survived)
+		}
+	}
+}
+
+func TestSetCacheEvictionPolicy(t *testing.T) {
+	ts := safeBrowsingTestServer(0, "wmconvirus.narod.ru")
+	defer ts.Close()
+	d := NewForTest()
+	defer d.Destroy()
+	d.EnableSafeBrowsing()
+	d.SetSafeBrowsingServer(ts.Listener.Addr().String())
+	defer SetCacheEvictionPolicy(CacheEvictionLRU)
+
+	d.checkMatch(t, "wmconvirus.narod.ru")
+	old, _ := lookupCaches()
+	SetCacheEvictionPolicy(CacheEvictionLFU)
+	current, _ := lookupCaches()
+	if current == old {
+		t.Fatalf("expected caches to be replaced")
+	}
+	if _, found := isLookupCached(current, "wmconvirus.narod.ru"); found {
+		t.Errorf("expected new cache to be empty")
+	}
+	d.checkMatch(t, "wmconvirus.narod.ru")
+	if cached, found := isLookupCached(current, "wmconvirus.narod.ru"); !found || cached.Reason != FilteredSafeBrowsing {
+		t.Errorf("expected lookup to use the new cache, got %v %v", cached, found)
+	}
+
+	// policy can be changed while checks are running
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				d.CheckHost("wmconvirus.narod.ru")
+				d.WouldLookup("example.org")
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		SetCacheEvictionPolicy(CacheEvictionPolicy(i % 2))
+	}
+	wg.Wait()
+}
+
+func TestRegexFullMatch(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.SetRegexFullMatch(true)
+	d.checkAddRule(t, "/example\\.org/")
+	d.checkAddRule(t, "/ads?\\.example\\.com|tracker\\.net/")
+
+	d.checkMatch(t, "example.org")
+	d.checkMatchEmpty(t, "testexample.org")
+	d.checkMatchEmpty(t, "test.example.org")
+	d.checkMatch(t, "ad.example.com")
+	d.checkMatch(t, "tracker.net")
+	d.checkMatchEmpty(t, "www.tracker.net")
+
+	// rules added before the change keep matching substrings
+	d2 := NewForTest()
+	defer d2.Destroy()
+	d2.checkAddRule(t, "/example\\.org/")
+	d2.SetRegexFullMatch(true)
+	d2.checkMatch(t, "testexample.org")
+}
+
+func TestMatchHook(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.checkAddRule(t, "||example.org^")
+	d.checkAddRule(t, "@@||test.example.org^")
+
+	events := []MatchEvent{}
+	d.SetMatchHook(func(event MatchEvent) {
+		events = append(events, event)
+	})
+	d.checkMatch(t, "example.org")
+	d.checkMatchEmpty(t, "test.example.org")
+	d.checkMatchEmpty(t, "Clean.example.COM.")
+
+	expected := []struct {
+		host   string
+		reason Reason
+		rule   string
+	}{
+		{"example.org", FilteredBlackList, "||example.org^"},
+		{"test.example.org", NotFilteredWhiteList, "||test.example.org^"},
+		{"clean.example.com", NotFilteredNotFound, ""},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("Expected %d events, got %d", len(expected), len(events))
+	}
+	for i, e := range expected {
+		event := events[i]
+		if event.Host != e.host || event.Result.Reason != e.reason || event.Rule != e.rule || event.Time.IsZero() {
+			t.Errorf("Unexpected event %d: %+v", i, event)
+		}
+	}
+
+	d.SetMatchHook(nil)
+	d.checkMatch(t, "example.org")
+	if len(events) != len(expected) {
+		t.Errorf("Hook must not be called after it is removed")
+	}
+}
+
+func TestBrowserOnlyModifiers(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.checkAddRuleFail(t, "||example.org^$popup")
+	d.checkAddRuleFail(t, "||example.net^$elemhide,csp=script-src 'self'")
+	d.checkAddRule(t, "@@||test.example.com^$important,generichide")
+	d.checkAddRule(t, "||example.com^")
+
+	d.checkMatchEmpty(t, "example.org")
+	d.checkMatch(t, "example.com")
+	d.checkMatchEmpty(t, "test.example.com")
+
+	skipped := d.SkippedRules()
+	if len(skipped) != 2 {
+		t.Fatalf("Expected 2 skipped rules, got %+v", skipped)
+	}
+	if skipped[0].Text != "||example.org^$popup" || !strings.Contains(skipped[0].Reason, "popup") {
+		t.Errorf("Unexpected skipped rule: %+v", skipped[0])
+	}
+
+	strict := NewForTest()
+	defer strict.Destroy()
+	strict.SetStrictModifiers(true)
+	strict.checkAddRuleFail(t, "@@||test.example.com^$important,generichide")
+	if len(strict.SkippedRules()) != 1 {
+		t.Errorf("Expected rule to be skipped in strict mode")
+	}
+}
+
+func TestSafeSearchCache(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.EnableSafeSearch()
+	resolved := 0
+	d.SetResolver(func(ctx context.Context, host string) ([]net.IP, error) {
+		resolved++
+		return []net.IP{net.IPv4(216, 239, 38, 120)}, nil
+	})
+
+	for i := 0; i < 2; i++ {
+		ips, err := d.SafeSearchResult("www.google.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ips) != 1 || !ips[0].Equal(net.IPv4(216, 239, 38, 120)) {
+			t.Errorf("Unexpected safesearch result: %v", ips)
+		}
+	}
+	if resolved != 1 {
+		t.Errorf("Expected second lookup within TTL to be cached, resolved %d times", resolved)
+	}
+
+	// yandex replacement is an IP already and needs no resolving
+	ips, err := d.SafeSearchResult("yandex.ru")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || resolved != 1 {
+		t.Errorf("Unexpected safesearch result for yandex.ru: %v", ips)
+	}
+
+	d.SetSafeSearchCacheTTL(time.Millisecond)
+	d.SafeSearchResult("www.google.com")
+	time.Sleep(5 * time.Millisecond)
+	d.SafeSearchResult("www.google.com")
+	if resolved != 3 {
+		t.Errorf("Expected expired entry to be resolved again, resolved %d times", resolved)
+	}
+}
+
+func TestSetResolver(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.EnableSafeSearch()
+	canned := map[string][]net.IP{
+		"strict.bing.com":            {net.ParseIP("204.79.197.220")},
+		"forcesafesearch.google.com": {net.ParseIP("216.239.38.120"), net.ParseIP("2001:4860:4802:32::78")},
+	}
+	d.SetResolver(func(ctx context.Context, host string) ([]net.IP, error) {
+		ips, ok := canned[host]
+		if !ok {
+			return nil, fmt.Errorf("unexpected host %s", host)
+		}
+		return ips, nil
+	})
+
+	for engine, target := range map[string]string{"www.bing.com": "strict.bing.com", "www.google.de": "forcesafesearch.google.com"} {
+		ips, err := d.SafeSearchResult(engine)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ips) != len(canned[target]) || !ips[0].Equal(canned[target][0]) {
+			t.Errorf("Expected %s to resolve to %v, got %v", engine, canned[target], ips)
+		}
+	}
+
+	ips, err := d.SafeSearchResult("example.org")
+	if err != nil || ips != nil {
+		t.Errorf("Expected no result for non-search engine host, got %v, %v", ips, err)
+	}
+}
+
+func TestDNSRewriteRCode(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.checkAddRule(t, "||nxdomain.example.org^$dnsrewrite=NXDOMAIN")
+	d.checkAddRule(t, "||refused.example.org^$dnsrewrite=REFUSED")
+	d.checkAddRule(t, "||nodata.example.org^$dnsrewrite=nodata")
+	d.checkAddRule(t, "||blocked.example.org^")
+
+	for host, rcode := range map[string]int{
+		"nxdomain.example.org":    3,
+		"www.refused.example.org": 5,
+		"nodata.example.org":      0,
+	} {
+		ret, err := d.CheckHost(host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ret.IsFiltered || ret.DNSRewrite == nil || ret.DNSRewrite.RCode != rcode {
+			t.Errorf("Expected %s to be rewritten with rcode %d, got %+v", host, rcode, ret)
+		}
+	}
+	ret, err := d.CheckHost("blocked.example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret.DNSRewrite != nil {
+		t.Errorf("Expected no rewrite for plain blocking rule, got %+v", ret.DNSRewrite)
+	}
+
+	err = d.AddRule("||example.com^$dnsrewrite=SOMETHING", 0)
+	if err != ErrInvalidDNSRewrite {
+		t.Errorf("Expected %v for malformed rewrite, got %v", ErrInvalidDNSRewrite, err)
+	}
+}
+
+func TestIsRuleErrorSkipsBadRewrite(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	list := []string{
+		"||example.com^$dnsrewrite=SOMETHING",
+		"||doubleclick.net^",
+	}
+	for _, line := range list {
+		err := d.AddRule(line, 0)
+		if IsRuleError(err) {
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Expected %q to be skipped or added, got %v", line, err)
+		}
+	}
+	d.checkMatch(t, "doubleclick.net")
+	d.checkMatchEmpty(t, "example.com")
+}
+
+func TestFilterPriority(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	for _, r := range []struct {
+		rule   string
+		listID uint32
+	}{
+		{"||ads.example.org^", 1},
+		{"@@||ads.example.org^", 2},
+		{"||tracker.example.org^", 3},
+		{"||important.example.org^$important", 3},
+		{"@@||important.example.org^", 1},
+	} {
+		err := d.AddRule(r.rule, r.listID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// by default whitelist wins
+	d.checkMatchEmpty(t, "ads.example.org")
+
+	d.SetFilterPriority([]uint32{1, 2})
+	d.checkMatch(t, "ads.example.org")
+	d.checkMatch(t, "tracker.example.org")
+	d.checkMatch(t, "important.example.org")
+
+	d.SetFilterPriority([]uint32{2, 1})
+	d.checkMatchEmpty(t, "ads.example.org")
+
+	// unlisted filters go after listed ones, lower ID first
+	d.SetFilterPriority([]uint32{3})
+	d.checkMatch(t, "ads.example.org")
+
+	d.SetFilterPriority(nil)
+	d.checkMatchEmpty(t, "ads.example.org")
+}
+
+func TestFindShadowedRules(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	rules := []string{
+		"||example.org^",
+		"||sub.example.org^",
+		"@@||allowed.net^",
+		"||ads.allowed.net^",
+		"@@||safe.net^",
+		"||safe.net^$important",
+		"||other.org^$dnsclass=CH",
+		"||www.other.org^",
+		"||sub.example.org^$dnsrewrite=NXDOMAIN",
+		"/example/",
+		"||badfilter.org^$badfilter",
+		"||sub.badfilter.org^",
+		"||labels.org^$labels=1",
+		"||sub.labels.org^",
+		"||protocol.org^$protocol=doh",
+		"||sub.protocol.org^",
+		"||encrypted.org^$protocol=doh|dot",
+		"||sub.encrypted.org^$protocol=dot",
+	}
+	ids := map[string]uint64{}
+	for _, text := range rules {
+		id, err := d.AddRuleID(text, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[text] = id
+	}
+
+	expected := map[string]string{
+		"||sub.example.org^":                "||example.org^",
+		"||ads.allowed.net^":                "@@||allowed.net^",
+		"@@||safe.net^":                     "||safe.net^$important",
+		"||sub.encrypted.org^$protocol=dot": "||encrypted.org^$protocol=doh|dot",
+	}
+	reports := d.FindShadowedRules()
+	if len(reports) != len(expected) {
+		t.Fatalf("expected %d shadowed rules, got %+v", len(expected), reports)
+	}
+	for _, report := range reports {
+		by, ok := expected[report.Rule.Text]
+		if !ok {
+			t.Errorf("rule %s is not expected to be shadowed", report.Rule.Text)
+			continue
+		}
+		if report.ShadowedBy.Text != by || report.ShadowedBy.ID != ids[by] {
+			t.Errorf("rule %s is expected to be shadowed by %s, got %+v", report.Rule.Text, by, report.ShadowedBy)
+		}
+	}
+	// $badfilter rule doesn't shadow the rule it doesn't target, which still decides the check
+	d.checkMatch(t, "sub.badfilter.org")
+
+	// disabled rules don't shadow anything
+	d.DisableRuleByID(ids["||example.org^"])
+	for _, report := range d.FindShadowedRules() {
+		if report.Rule.Text == "||sub.example.org^" {
+			t.Errorf("rule %s is shadowed by disabled rule", report.Rule.Text)
+		}
+	}
+}
+
+func TestClientRule(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	for _, rule := range []string{
+		"||geo.example.org^$client=192.0.2.0/24",
+		"||single.example.org^$client=198.51.100.1|2001:db8::1",
+	} {
+		err := d.AddRule(rule, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, rule := range []string{"||example.org^$client=", "||example.org^$client=1.2.3", "||example.org^$client=1.2.3.4/33"} {
+		if err := d.AddRule(rule, 0); err != ErrInvalidSyntax {
+			t.Errorf("rule %s is expected to fail with ErrInvalidSyntax, got %v", rule, err)
+		}
+	}
+
+	_, inside, _ := net.ParseCIDR("192.0.2.128/25")
+	_, wider, _ := net.ParseCIDR("192.0.0.0/16")
+	_, outside, _ := net.ParseCIDR("203.0.113.0/24")
+	resolverIP := net.ParseIP("203.0.113.53")
+	tests := []struct {
+		host     string
+		clientIP net.IP
+		ecs      *net.IPNet
+		filtered bool
+	}{
+		{"geo.example.org", nil, nil, false},
+		{"geo.example.org", net.ParseIP("192.0.2.10"), nil, true},
+		{"sub.geo.example.org", net.ParseIP("192.0.2.10"), nil, true},
+		{"geo.example.org", resolverIP, nil, false},
+		// ECS inside blocked network wins over resolver's own address
+		{"geo.example.org", resolverIP, inside, true},
+		{"geo.example.org", net.ParseIP("192.0.2.10"), outside, false},
+		{"geo.example.org", resolverIP, wider, false},
+		{"single.example.org", net.ParseIP("198.51.100.1"), nil, true},
+		{"single.example.org", net.ParseIP("198.51.100.2"), nil, false},
+		{"single.example.org", net.ParseIP("2001:db8::1"), nil, true},
+	}
+	for _, test := range tests {
+		res, err := d.CheckHostForClient(test.host, test.clientIP, test.ecs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.IsFiltered != test.filtered {
+			t.Errorf("host %s for client %s and ECS %v is expected to be filtered: %v, got %+v", test.host, test.clientIP, test.ecs, test.filtered, res)
+		}
+	}
+
+	// rules with $client don't apply without client info
+	d.checkMatchEmpty(t, "geo.example.org")
+}
+
+func TestClone(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	for _, rule := range []string{"||example.org^", "@@||allowed.example.org^", "/regex[0-9]+/", "||disabled.org^"} {
+		err := d.AddRule(rule, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	disabledID := d.Rules(-1)[3].ID
+	d.DisableRuleByID(disabledID)
+	d.SetFilterPriority([]uint32{1})
+
+	c := d.Clone()
+	defer c.Destroy()
+	if c.Count() != d.Count() {
+		t.Fatalf("expected clone to have %d rules, got %d", d.Count(), c.Count())
+	}
+	c.checkMatch(t, "example.org")
+	c.checkMatchEmpty(t, "allowed.example.org")
+	c.checkMatch(t, "regex123")
+	c.checkMatchEmpty(t, "disabled.org")
+	count, bytes := c.RegexStats()
+	if origCount, origBytes := d.RegexStats(); count != origCount || bytes != origBytes {
+		t.Errorf("expected clone to have regex stats %d, %d, got %d, %d", origCount, origBytes, count, bytes)
+	}
+
+	// rule IDs continue from the original
+	id, err := c.AddRuleID("||new.example.org^", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id <= disabledID {
+		t.Errorf("expected rule added to clone to get new ID, got %d", id)
+	}
+	c.EnableRuleByID(disabledID)
+	c.RemoveRuleByID(d.Rules(-1)[0].ID)
+	c.SetFilterPriority(nil)
+	if d.Count() != 4 {
+		t.Errorf("expected original to still have 4 rules, got %d", d.Count())
+	}
+	d.checkMatch(t, "example.org")
+	d.checkMatchEmpty(t, "disabled.org")
+	c.checkMatch(t, "disabled.org")
+	c.checkMatchEmpty(t, "example.org")
+	if d.config.filterPriority == nil {
+		t.Errorf("filter priority of the original was changed by clone")
+	}
+}
+
+func TestRuleHits(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	blockID, err := d.AddRuleID("||example.org^", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowID, err := d.AddRuleID("@@||allowed.example.org^", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unusedID, err := d.AddRuleID("||unused.org^", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 5
+	for i := 0; i < n; i++ {
+		d.checkMatch(t, "www.example.org")
+	}
+	d.checkMatchEmpty(t, "allowed.example.org")
+	d.checkMatchEmpty(t, "other.org")
+
+	hits := d.RuleHits()
+	expected := map[uint64]uint64{blockID: n, allowID: 1, unusedID: 0}
+	if len(hits) != len(expected) {
+		t.Fatalf("expected hits for %d rules, got %v", len(expected), hits)
+	}
+	for id, count := range expected {
+		if hits[id] != count {
+			t.Errorf("expected rule %d to have %d hits, got %d", id, count, hits[id])
+		}
+	}
+
+	// rules are kept and keep counting after hits are reset
+	d.ResetHits()
+	for id, count := range d.RuleHits() {
+		if count != 0 {
+			t.Errorf("expected rule %d to have no hits after ResetHits, got %d", id, count)
+		}
+	}
+	d.checkMatch(t, "www.example.org")
+	if hits := d.RuleHits(); len(hits) != len(expected) || hits[blockID] != 1 {
+		t.Errorf("expected all rules to be kept and rule %d to have 1 hit after ResetHits, got %v", blockID, hits)
+	}
+
+	d.RemoveAllRules()
+	if d.Count() != 0 || len(d.RuleHits()) != 0 {
+		t.Errorf("expected no rules and hits after RemoveAllRules, got %d rules and %v", d.Count(), d.RuleHits())
+	}
+	d.checkMatchEmpty(t, "www.example.org")
+}
+
+func TestSafeSearchCaseInsensitive(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.EnableSafeSearch()
+	tests := []struct {
+		host     string
+		expected string
+	}{
+		{"WWW.Google.COM", "forcesafesearch.google.com"},
+		{"www.google.com.", "forcesafesearch.google.com"},
+		{"WWW.GOOGLE.CO.UK.", "forcesafesearch.google.com"},
+		{"www.Bing.com", "strict.bing.com"},
+		{"www.bing.com.", "strict.bing.com"},
+		{"YANDEX.RU", "213.180.193.56"},
+		{"yandex.com.", "213.180.193.56"},
+	}
+	for _, test := range tests {
+		val, ok := d.SafeSearchDomain(test.host)
+		if !ok || val != test.expected {
+			t.Errorf("expected safesearch for %s to be %s, got %s", test.host, test.expected, val)
+		}
+	}
+}
+
+func TestSafeSearchMapping(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.EnableSafeSearch()
+
+	err := d.SetSafeSearchMapping(map[string]SafeSearchTarget{
+		"www.google.com":      "safe.google.example",
+		"search.example.org.": "192.0.2.1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host     string
+		expected string
+	}{
+		{"www.google.com", "safe.google.example"},
+		{"www.google.de", "forcesafesearch.google.com"},
+		{"search.example.org", "192.0.2.1"},
+	}
+	for _, test := range tests {
+		val, ok := d.SafeSearchDomain(test.host)
+		if !ok || val != test.expected {
+			t.Errorf("expected safesearch for %s to be %s, got %s", test.host, test.expected, val)
+		}
+	}
+
+	for _, mapping := range []map[string]SafeSearchTarget{
+		{"www.google.com": ""},
+		{"": "safe.google.example"},
+		{"www.google.com": "bad host"},
+	} {
+		if err := d.SetSafeSearchMapping(mapping); err != ErrInvalidSafeSearchTarget {
+			t.Errorf("expected %v to be rejected, got %v", mapping, err)
+		}
+	}
+	if val, _ := d.SafeSearchDomain("www.google.com"); val != "safe.google.example" {
+		t.Errorf("invalid mapping must not change the table, got %s", val)
+	}
+
+	d.SetSafeSearchMapping(nil)
+	if val, _ := d.SafeSearchDomain("www.google.com"); val != "forcesafesearch.google.com" {
+		t.Errorf("expected built-in table to be restored, got %s", val)
+	}
+}
+
+func TestWouldLookup(t *testing.T) {
+	sb := safeBrowsingTestServer(0, "wmconvirus.narod.ru")
+	defer sb.Close()
+	pc := parentalTestServer("pornhub.com")
+	defer pc.Close()
+	d := NewForTest()
+	defer d.Destroy()
+	d.checkAddRule(t, "||doubleclick.net^")
+
+	if sb, pc := d.WouldLookup("example.org"); sb || pc {
+		t.Errorf("expected no lookups with safebrowsing and parental disabled")
+	}
+
+	d.EnableSafeBrowsing()
+	d.SetSafeBrowsingServer(sb.Listener.Addr().String())
+	d.EnableParental(3)
+	d.SetParentalServer(pc.Listener.Addr().String())
+
+	if sb, pc := d.WouldLookup("example.org"); !sb || !pc {
+		t.Errorf("expected both lookups for example.org, got %v, %v", sb, pc)
+	}
+	if sb, pc := d.WouldLookup("ads.doubleclick.net"); sb || pc {
+		t.Errorf("expected no lookups for host blocked by rules, got %v, %v", sb, pc)
+	}
+
+	d.checkMatchEmpty(t, "example.org")
+	if sb, pc := d.WouldLookup("example.org."); sb || pc {
+		t.Errorf("expected no lookups for cached host, got %v, %v", sb, pc)
+	}
+
+	d.checkMatch(t, "wmconvirus.narod.ru")
+	if sb, pc := d.WouldLookup("wmconvirus.narod.ru"); sb || pc {
+		t.Errorf("expected no lookups for host cached by safebrowsing, got %v, %v", sb, pc)
+	}
+}
+
+func TestWarmupCancelAbortsLookups(t *testing.T) {
+	// server hangs until the client goes away
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+	d := NewForTest()
+	defer d.Destroy()
+	d.EnableSafeBrowsing()
+	d.SetSafeBrowsingServer(ts.Listener.Addr().String())
+	d.SetHTTPTimeout(time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- d.Warmup(ctx, []string{"example.org", "example.com"})
+	}()
+	for d.StatsSnapshot().Safebrowsing.Pending == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("expected warmup to be cancelled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("in-flight lookups weren't aborted when warmup was cancelled")
+	}
+}
+
+func TestWouldLookupBlockedTLDsAndExemptClients(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.EnableSafeBrowsing()
+	d.SetBlockedTLDs([]string{"xyz"})
+	d.checkAddRule(t, "@@||good.xyz^")
+	_, admins, _ := net.ParseCIDR("192.168.1.0/24")
+	d.SetSafeBrowsingExemptClients([]net.IPNet{*admins})
+
+	if sb, _ := d.WouldLookup("qwkjhz.xyz"); sb {
+		t.Errorf("expected no lookup for host under blocked TLD")
+	}
+	if sb, _ := d.WouldLookup("good.xyz"); sb {
+		t.Errorf("expected no lookup for whitelisted host")
+	}
+	if sb, _ := d.WouldLookup("example.org"); !sb {
+		t.Errorf("expected lookup for other hosts")
+	}
+	if sb, _ := d.WouldLookupForClient("example.org", net.ParseIP("192.168.1.5"), nil); sb {
+		t.Errorf("expected no lookup for exempt client")
+	}
+	if sb, _ := d.WouldLookupForClient("example.org", net.ParseIP("10.0.0.5"), nil); !sb {
+		t.Errorf("expected lookup for other clients")
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	sb := safeBrowsingTestServer(0, "wmconvirus.narod.ru")
+	defer sb.Close()
+	parental := parentalTestServer("pornhub.com")
+	defer parental.Close()
+	d := NewForTest()
+	defer d.Destroy()
+	d.EnableSafeBrowsing()
+	d.SetSafeBrowsingServer(sb.Listener.Addr().String())
+	err := d.EnableParental(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.SetParentalServer(parental.Listener.Addr().String())
+
+	hosts := []string{"wmconvirus.narod.ru", "pornhub.com", "WWW.Example.ORG.", ""}
+	err = d.Warmup(context.Background(), hosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := d.StatsSnapshot().Safebrowsing.Requests + d.StatsSnapshot().Parental.Requests
+	d.checkMatch(t, "wmconvirus.narod.ru")
+	d.checkMatch(t, "pornhub.com")
+	d.checkMatchEmpty(t, "www.example.org")
+	after := d.StatsSnapshot().Safebrowsing.Requests + d.StatsSnapshot().Parental.Requests
+	if after != requests {
+		t.Errorf("expected no lookups for warmed up hosts, got %d", after-requests)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = d.Warmup(ctx, []string{"example.com"})
+	if err != context.Canceled {
+		t.Errorf("expected warmup to be cancelled, got %v", err)
+	}
+
+	// lookup errors are reported
+	d.SetSafeBrowsingServer("127.0.0.1:1")
+	err = d.Warmup(context.Background(), []string{"example.net", "example.com"})
+	if werr, ok := err.(WarmupError); !ok || len(werr) != 2 {
+		t.Errorf("expected warmup errors for 2 hosts, got %v", err)
+	}
+}
+
+func TestAllModifier(t *testing.T) {
+	plain := NewForTest()
+	defer plain.Destroy()
+	plain.checkAddRule(t, "||example.org^")
+	d := NewForTest()
+	defer d.Destroy()
+	d.checkAddRule(t, "||example.org^$all")
+	d.checkAddRule(t, "@@||allowed.example.org^$all")
+
+	for _, host := range []string{"example.org", "www.example.org", "EXAMPLE.org.", "example.com", "notexample.org"} {
+		expected, err := plain.CheckHost(host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := d.CheckHost(host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.IsFiltered != expected.IsFiltered {
+			t.Errorf("expected %s to be filtered: %v, got %+v", host, expected.IsFiltered, res)
+		}
+	}
+	d.checkMatchEmpty(t, "allowed.example.org")
+}
+
+func TestNearMatches(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.checkAddRule(t, "||doubleclick.net^")
+	d.checkAddRule(t, "@@||click.net^")
+	d.checkAddRule(t, "||ads.org^$important")
+	d.checkAddRule(t, "/doubleclick/")
+
+	tests := []struct {
+		host     string
+		expected []string
+	}{
+		{"nodoubleclick.net", []string{"@@||click.net^", "||doubleclick.net^"}},
+		{"doubleclick.net.ru", []string{"@@||click.net^", "||doubleclick.net^"}},
+		{"doubleclick.net", []string{"@@||click.net^"}},
+		{"click.net", []string{}},
+		{"badads.org", []string{"||ads.org^$important"}},
+		{"example.org", []string{}},
+	}
+	for _, test := range tests {
+		near := d.NearMatches(test.host)
+		if !reflect.DeepEqual(near, test.expected) {
+			t.Errorf("expected near matches for %s to be %v, got %v", test.host, test.expected, near)
+		}
+	}
+}
+
+func TestInvalidHost(t *testing.T) {
+	ts := safeBrowsingTestServer(0)
+	defer ts.Close()
+	d := NewForTest()
+	defer d.Destroy()
+	d.checkAddRule(t, "/.*/")
+	d.EnableSafeBrowsing()
+	d.SetSafeBrowsingServer(ts.Listener.Addr().String())
+	requests := d.StatsSnapshot().Safebrowsing.Requests
+
+	tests := []struct {
+		host string
+		err  error
+	}{
+		{"", nil},
+		{".", nil},
+		{"  ", nil},
+		{"exa mple.org", ErrInvalidHost},
+		{"example.org/path", ErrInvalidHost},
+		{"example..org", ErrInvalidHost},
+		{"..", ErrInvalidHost},
+		{"exam\x00ple.org", ErrInvalidHost},
+	}
+	for _, test := range tests {
+		res, err := d.CheckHost(test.host)
+		if err != test.err {
+			t.Errorf("expected error %v for host %q, got %v", test.err, test.host, err)
+		}
+		if res.Reason != NotFilteredNotFound {
+			t.Errorf("expected host %q to not be checked, got %+v", test.host, res)
+		}
+	}
+	if after := d.StatsSnapshot().Safebrowsing.Requests; after != requests {
+		t.Errorf("expected no safebrowsing requests for invalid hosts, got %d", after-requests)
+	}
+}
+
+// semicolonDecoder reads lists that start with `SEMI` and have rules separated by semicolons
+type semicolonDecoder struct{}
+
+func (semicolonDecoder) Sniff(header []byte) bool {
+	return bytes.HasPrefix(header, []byte("SEMI"))
+}
+
+func (semicolonDecoder) Decode(r io.Reader, fn func(line string) error) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(strings.TrimPrefix(string(data), "SEMI"), ";") {
+		err = fn(line)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestRuleDecoder(t *testing.T) {
+	RegisterRuleDecoder(semicolonDecoder{})
+	defer func() {
+		ruleDecoders = nil
+	}()
+
+	d := NewForTest()
+	defer d.Destroy()
+	added, err := d.LoadRulesFromReader(strings.NewReader("SEMI||example.org^;@@||allowed.example.org^;! Filter ID: 2;||example.com^"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 3 || d.CountByFilter(1) != 2 || d.CountByFilter(2) != 1 {
+		t.Fatalf("expected 3 rules to be added, got %d", added)
+	}
+	d.checkMatch(t, "example.org")
+	d.checkMatchEmpty(t, "allowed.example.org")
+	d.checkMatch(t, "example.com")
+
+	// plain text lists are still loaded by default decoder
+	added, err = d.LoadRulesFromReader(strings.NewReader("||example.net^\n||example.info^\n"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 2 {
+		t.Fatalf("expected 2 rules to be added, got %d", added)
+	}
+	d.checkMatch(t, "example.net")
+}
+
+// roundTripperFunc lets a function be used as http.RoundTripper
+type roundTripperFunc func(r *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestParentalServer(t *testing.T) {
+	ts := parentalTestServer("pornhub.com")
+	defer ts.Close()
+	d := NewForTest()
+	defer d.Destroy()
+	err := d.EnableParental(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.SetParentalServer(ts.Listener.Addr().String())
+	res, err := d.CheckHost("www.pornhub.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Reason != FilteredParental || res.Rule != "parental PORN" {
+		t.Errorf("expected www.pornhub.com to be blocked by parental, got %+v", res)
+	}
+	d.checkMatchEmpty(t, "example.org")
+
+	// custom transport is used for parental lookups
+	purgeCaches()
+	var requests int32
+	d.SetParentalTransport(roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&requests, 1)
+		return http.DefaultTransport.RoundTrip(r)
+	}))
+	d.checkMatch(t, "pornhub.com")
+	if atomic.LoadInt32(&requests) != 1 {
+		t.Errorf("expected 1 request through parental transport, got %d", requests)
+	}
+
+	d.SetParentalServer("")
+	if d.config.parentalServer != defaultParentalServer {
+		t.Errorf("expected parental server to be reset to default, got %s", d.config.parentalServer)
+	}
+}
+
+func TestExportRulesDeterministic(t *testing.T) {
+	rules := []struct {
+		text   string
+		listID uint32
+	}{
+		{"||example.org^", 2},
+		{"@@||allowed.example.org^", 1},
+		{"/regex[0-9]/", 2},
+		{"||a.example.com^", 1},
+		{"||b.example.com^$important", 3},
+		{"||c.example.com^", 2},
+	}
+	first := NewForTest()
+	defer first.Destroy()
+	for _, r := range rules {
+		first.AddRule(r.text, r.listID)
+	}
+	second := NewForTest()
+	defer second.Destroy()
+	for i := len(rules) - 1; i >= 0; i-- {
+		second.AddRule(rules[i].text, rules[i].listID)
+	}
+
+	var firstExport, secondExport bytes.Buffer
+	if err := first.ExportRules(&firstExport); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.ExportRules(&secondExport); err != nil {
+		t.Fatal(err)
+	}
+	if firstExport.String() != secondExport.String() {
+		t.Errorf("expected exports to be identical, got:\n%s\nand:\n%s", firstExport.String(), secondExport.String())
+	}
+	expected := "! Filter ID: 1\n@@||allowed.example.org^\n||a.example.com^\n" +
+		"! Filter ID: 2\n/regex[0-9]/\n||c.example.com^\n||example.org^\n" +
+		"! Filter ID: 3\n||b.example.com^$important\n"
+	if firstExport.String() != expected {
+		t.Errorf("expected export:\n%s\ngot:\n%s", expected, firstExport.String())
+	}
+}
+
+func TestDomainModifier(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.checkAddRule(t, "||example.org^$domain=ads.example.org|~safe.ads.example.org")
+	d.checkAddRule(t, "||example.com^$domain=~www.example.com|~cdn.example.com")
+	d.checkAddRule(t, "/tracker/$domain=example.net|example.info")
+	// $domain can never match hostnames of this rule, so it's ignored
+	d.checkAddRule(t, "||example.biz^$domain=example.org")
+	d.checkAddRuleFail(t, "||example.edu^$domain=")
+	d.checkAddRuleFail(t, "||example.edu^$domain=a.com|~")
+	// anchors alone are not a pattern
+	d.checkAddRuleFail(t, "|$domain=a.com")
+	d.checkAddRuleFail(t, "@@|$domain=x.com")
+	d.checkAddRuleFail(t, "||$domain=a.com")
+
+	d.checkMatch(t, "ads.example.org")
+	d.checkMatch(t, "x.ads.example.org")
+	d.checkMatchEmpty(t, "example.org")
+	d.checkMatchEmpty(t, "safe.ads.example.org")
+	d.checkMatch(t, "example.com")
+	d.checkMatch(t, "ads.example.com")
+	d.checkMatchEmpty(t, "www.example.com")
+	d.checkMatchEmpty(t, "img.cdn.example.com")
+	d.checkMatch(t, "tracker.example.net")
+	d.checkMatchEmpty(t, "tracker.example.org")
+	d.checkMatch(t, "example.biz")
+
+	strict := NewForTest()
+	defer strict.Destroy()
+	strict.SetStrictModifiers(true)
+	strict.checkAddRule(t, "||example.org^$domain=ads.example.org|~safe.ads.example.org")
+	strict.checkAddRuleFail(t, "||example.biz^$domain=example.org")
+}
+
+func TestSafeBrowsingRateLimit(t *testing.T) {
+	const rps = 20
+	const lookups = 40
+	var requests, firstSecond int32
+	start := time.Now()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if time.Since(start) < time.Second {
+			atomic.AddInt32(&firstSecond, 1)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+	d := NewForTest()
+	defer d.Destroy()
+	d.EnableSafeBrowsing()
+	d.SetSafeBrowsingServer(ts.Listener.Addr().String())
+	d.SetSafeBrowsingRateLimit(rps)
+
+	var wg sync.WaitGroup
+	for i := 0; i < lookups; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			d.checkMatchEmpty(t, fmt.Sprintf("host%d.example.org", i))
+		}(i)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	if atomic.LoadInt32(&requests) != lookups {
+		t.Errorf("expected %d requests, got %d", lookups, requests)
+	}
+	if n := atomic.LoadInt32(&firstSecond); n > rps {
+		t.Errorf("expected at most %d requests within the first second, got %d", rps, n)
+	}
+	// there is no initial burst, all requests go at rps
+	if min := time.Duration(lookups-1) * time.Second / rps * 9 / 10; elapsed < min {
+		t.Errorf("expected %d lookups to take at least %s, took %s", lookups, min, elapsed)
+	}
+
+	// lookups that can't wait for their turn fail open
+	d.SetSafeBrowsingRateLimit(1)
+	d.SetHTTPTimeout(10 * time.Millisecond)
+	d.checkMatchEmpty(t, "first.example.org")
+	_, err := d.checkSafeBrowsing(context.Background(), "second.example.org")
+	if err != ErrRateLimited {
+		t.Errorf("expected lookup to be rate limited, got %v", err)
+	}
+	d.checkMatchEmpty(t, "third.example.org")
+}
+
+func TestSafeBrowsingThreatType(t *testing.T) {
+	lists := map[string]string{
+		"malware.example.org":  "adguard-malware-shavar",
+		"phishing.example.org": "adguard-phishing-shavar",
+		"unwanted.example.org": "adguard-unwanted-shavar",
+		"other.example.org":    "adguard-other-shavar",
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for host, list := range lists {
+			sum := sha256.Sum256([]byte(host + "/"))
+			fmt.Fprintf(w, "%s:1:%X\n", list, sum)
+		}
+	}))
+	defer ts.Close()
+	d := NewForTest()
+	defer d.Destroy()
+	d.EnableSafeBrowsing()
+	d.SetSafeBrowsingServer(ts.Listener.Addr().String())
+
+	tests := map[string]ThreatType{
+		"malware.example.org":      ThreatMalware,
+		"www.phishing.example.org": ThreatPhishing,
+		"unwanted.example.org":     ThreatUnwanted,
+		"other.example.org":        ThreatUnknown,
+	}
+	for i := 0; i < 2; i++ {
+		// second time results come from cache
+		for host, threat := range tests {
+			res, err := d.CheckHost(host)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Reason != FilteredSafeBrowsing || res.ThreatType != threat {
+				t.Errorf("expected %s to be blocked as %s, got %+v", host, threat, res)
+			}
+		}
+	}
+	d.checkMatchEmpty(t, "example.org")
+}
+
+func TestBlockingIP(t *testing.T) {
+	sb := safeBrowsingTestServer(0, "wmconvirus.narod.ru")
+	defer sb.Close()
+	d := NewForTest()
+	defer d.Destroy()
+	d.EnableSafeBrowsing()
+	d.SetSafeBrowsingServer(sb.Listener.Addr().String())
+	d.checkAddRule(t, "||example.org^")
+	d.checkAddRule(t, "@@||allowed.example.org^")
+	d.checkAddRule(t, "||refused.example.com^$dnsrewrite=REFUSED")
+
+	res, err := d.CheckHost("example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.BlockedResponse != nil {
+		t.Errorf("expected no blocking IP by default, got %+v", res.BlockedResponse)
+	}
+
+	d.SetBlockingIP(net.ParseIP("0.0.0.0"), net.ParseIP("::"))
+	for _, host := range []string{"example.org", "wmconvirus.narod.ru"} {
+		res, err = d.CheckHost(host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.BlockedResponse == nil || !res.BlockedResponse.IPv4.Equal(net.IPv4zero) || !res.BlockedResponse.IPv6.Equal(net.IPv6unspecified) {
+			t.Errorf("expected %s to be blocked with configured IPs, got %+v", host, res)
+		}
+	}
+	for _, host := range []string{"allowed.example.org", "refused.example.com", "example.net"} {
+		res, err = d.CheckHost(host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.BlockedResponse != nil {
+			t.Errorf("expected no blocking IP for %s, got %+v", host, res.BlockedResponse)
+		}
+	}
+
+	d.SetBlockingIP(net.ParseIP("192.0.2.1"), nil)
+	res, err = d.CheckHost("example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.BlockedResponse == nil || res.BlockedResponse.IPv4.String() != "192.0.2.1" || res.BlockedResponse.IPv6 != nil {
+		t.Errorf("expected example.org to be blocked with 192.0.2.1 and NXDOMAIN for IPv6, got %+v", res.BlockedResponse)
+	}
+}
+
+func TestMaxLabelsModifier(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.checkAddRule(t, "||evil.com^$maxlabels=2")
+	d.checkAddRule(t, "||example.org^$maxlabels=0")
+	d.checkAddRuleFail(t, "||evil.net^$maxlabels=-1")
+	d.checkAddRuleFail(t, "||evil.net^$maxlabels=many")
+	d.checkAddRuleFail(t, "/evil/$maxlabels=1")
+	d.checkAddRuleFail(t, "|$maxlabels=1")
+	d.checkAddRuleFail(t, "||$maxlabels=1")
+
+	d.checkMatchEmpty(t, "evil.com")
+	d.checkMatchEmpty(t, "a.evil.com")
+	d.checkMatchEmpty(t, "a.b.evil.com")
+	d.checkMatch(t, "a.b.c.evil.com")
+	d.checkMatch(t, "a.b.c.d.e.evil.com")
+	d.checkMatchEmpty(t, "a.b.c.notevil.com")
+
+	d.checkMatchEmpty(t, "example.org")
+	d.checkMatch(t, "www.example.org")
+}
+
+func TestLabelsModifier(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.checkAddRule(t, "||example.com^$labels=1")
+	d.checkAddRule(t, "||example.org^$labels=0")
+	d.checkAddRule(t, "||example.net^$labels=2")
+	for _, rule := range []string{"||evil.net^$labels=-1", "||evil.net^$labels=one", "||evil.net^$labels="} {
+		if err := d.AddRule(rule, 0); err != ErrInvalidLabels {
+			t.Errorf("expected %s to be rejected with ErrInvalidLabels, got %v", rule, err)
+		}
+	}
+	d.checkAddRuleFail(t, "/evil/$labels=1")
+	d.checkAddRuleFail(t, "||$labels=1")
+	d.checkAddRuleFail(t, "@@|$labels=0")
+
+	d.checkMatchEmpty(t, "example.com")
+	d.checkMatch(t, "a.example.com")
+	d.checkMatchEmpty(t, "a.b.example.com")
+	d.checkMatchEmpty(t, "a.notexample.com")
+
+	d.checkMatch(t, "example.org")
+	d.checkMatchEmpty(t, "www.example.org")
+
+	d.checkMatchEmpty(t, "example.net")
+	d.checkMatchEmpty(t, "a.example.net")
+	d.checkMatch(t, "a.b.example.net")
+	d.checkMatchEmpty(t, "a.b.c.example.net")
+}
+
+func TestProtocolModifier(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.SetResultCache(10)
+	d.checkAddRule(t, "||example.org^$protocol=doh")
+	d.checkAddRule(t, "||example.com^$protocol=dot|DoH")
+	d.checkAddRule(t, "||example.net^")
+	d.checkAddRuleFail(t, "||example.info^$protocol=http")
+	d.checkAddRuleFail(t, "||example.info^$protocol=")
+
+	tests := []struct {
+		host     string
+		protocol string
+		filtered bool
+	}{
+		{"example.org", ProtocolDoH, true},
+		{"www.example.org", "DOH", true},
+		{"example.org", ProtocolUDP, false},
+		{"example.org", ProtocolDoT, false},
+		{"example.org", "", false},
+		{"example.com", ProtocolDoT, true},
+		{"example.com", ProtocolDoH, true},
+		{"example.com", ProtocolTCP, false},
+		{"example.net", ProtocolUDP, true},
+		{"example.net", "", true},
+	}
+	for _, test := range tests {
+		res, err := d.CheckHostMeta(test.host, QueryMeta{Protocol: test.protocol})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.IsFiltered != test.filtered {
+			t.Errorf("expected %s over %q to be filtered: %v, got %+v", test.host, test.protocol, test.filtered, res)
+		}
+	}
+	d.checkMatchEmpty(t, "example.org")
+}
+
+func TestAddRuleChanged(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	changed, err := d.AddRuleChanged("||example.org^", 0)
+	if err != nil || !changed {
+		t.Errorf("expected first add to change state, got %v, %v", changed, err)
+	}
+	changed, err = d.AddRuleChanged("||example.org^", 0)
+	if err != nil || changed {
+		t.Errorf("expected second add to be a no-op, got %v, %v", changed, err)
+	}
+	changed, err = d.AddRuleChanged("  ||example.org^ ", 1)
+	if err != nil || changed {
+		t.Errorf("expected add of the same rule with spaces to be a no-op, got %v, %v", changed, err)
+	}
+	changed, err = d.AddRuleChanged("! comment", 0)
+	if err != ErrInvalidSyntax || changed {
+		t.Errorf("expected invalid rule to fail, got %v, %v", changed, err)
+	}
+	if d.Count() != 1 {
+		t.Errorf("expected 1 rule, got %d", d.Count())
+	}
+	// AddRule still reports duplicates as invalid
+	d.checkAddRuleFail(t, "||example.org^")
+	if err = d.AddRule("||example.org^", 0); err != ErrInvalidSyntax {
+		t.Errorf("expected AddRule of duplicate to fail with ErrInvalidSyntax, got %v", err)
+	}
+}
+
+func TestMatchHookMeta(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.checkAddRule(t, "||example.org^")
+	var events []MatchEvent
+	d.SetMatchHook(func(event MatchEvent) {
+		events = append(events, event)
+	})
+
+	const typeAAAA = 28
+	_, err := d.CheckHostType("example.org", typeAAAA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientIP := net.ParseIP("192.0.2.1")
+	_, err = d.CheckHostMeta("www.example.org", QueryMeta{QType: 1, ClientIP: clientIP, Protocol: "doh"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.CheckHost("example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events, got %d", len(events))
+	}
+	if events[0].Meta.QType != typeAAAA || !events[0].Result.IsFiltered {
+		t.Errorf("expected event with query type AAAA, got %+v", events[0])
+	}
+	meta := events[1].Meta
+	if meta.QType != 1 || !meta.ClientIP.Equal(clientIP) || meta.Protocol != "doh" {
+		t.Errorf("expected event to carry query details, got %+v", meta)
+	}
+	if !reflect.DeepEqual(events[2].Meta, QueryMeta{}) {
+		t.Errorf("expected no query details for CheckHost, got %+v", events[2].Meta)
+	}
+}
+
+func TestLoadRulesBrokenRegexp(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	list := "! comment\n||example.org^\n/ads[0-9/\n||example.com^\n||example.org^\n/(unclosed/\n/tracker[0-9]+/\n"
+	result, err := d.LoadRules(strings.NewReader(list), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Added != 3 {
+		t.Errorf("expected 3 rules to be added, got %d", result.Added)
+	}
+	if len(result.Errors) != 2 {
+		t.Fatalf("expected 2 rule errors, got %v", result.Errors)
+	}
+	expected := []LineError{{Line: 3, Text: "/ads[0-9/"}, {Line: 6, Text: "/(unclosed/"}}
+	for i, e := range expected {
+		got := result.Errors[i]
+		if got.Line != e.Line || got.Text != e.Text || got.Err == nil {
+			t.Errorf("expected error for line %d %s, got %v", e.Line, e.Text, got)
+		}
+	}
+	d.checkMatch(t, "tracker42")
+
+	// AddRule rejects such rules as invalid too
+	d.checkAddRuleFail(t, "/ads[0-9/")
+	if err = d.AddRule("/ads[0-9/", 0); err != ErrInvalidSyntax {
+		t.Errorf("expected ErrInvalidSyntax, got %v", err)
+	}
+}
+
+func TestMatchRule(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	tests := []struct {
+		rule    string
+		host    string
+		matched bool
+	}{
+		{"test*.example.org^", "test.example.org", true},
+		{"test*.example.org^", "test2.example.org", true},
+		{"test*.example.org^", "example.org", false},
+		{"test*.example.org^", "testexample.org", false},
+		{"exam*.com", "example.com", true},
+		{"exam*.com", "exampleeee.com", true},
+		{"exam*.com", "example.co.uk", false},
+		{"@@||example.org^", "WWW.example.org.", true},
+		{"||192.0.2.0/24^", "192.0.2.1", true},
+		{"||192.0.2.0/24^", "example.org", false},
+	}
+	for _, test := range tests {
+		matched, err := d.MatchRule(test.rule, test.host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if matched != test.matched {
+			t.Errorf("expected rule %s to match %s: %v, got %v", test.rule, test.host, test.matched, matched)
+		}
+	}
+
+	for _, rule := range []string{"! comment", "/broken[/", "||example.org^$popup"} {
+		if _, err := d.MatchRule(rule, "example.org"); err != ErrInvalidSyntax {
+			t.Errorf("expected rule %s to fail with ErrInvalidSyntax, got %v", rule, err)
+		}
+	}
+	d.SetStrictModifiers(true)
+	if _, err := d.MatchRule("||example.org^$unknown", "example.org"); err != ErrUnknownModifier {
+		t.Errorf("expected ErrUnknownModifier, got %v", err)
+	}
+	d.SetStrictModifiers(false)
+	if _, err := d.MatchRule("||example.org^", "exa mple.org"); err != ErrInvalidHost {
+		t.Errorf("expected ErrInvalidHost, got %v", err)
+	}
+	if d.Count() != 0 || len(d.SkippedRules()) != 0 {
+		t.Errorf("expected MatchRule to not add rules, got %d rules and %d skipped", d.Count(), len(d.SkippedRules()))
+	}
+}
+
+func TestImportantWhitelist(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	// added in order that would let blocking rule win if it was checked first
+	d.checkAddRule(t, "||test.example.org^$important")
+	d.checkAddRule(t, "@@||test.example.org^$important")
+	d.checkAddRule(t, "||example.com^")
+	d.checkAddRule(t, "@@||example.com^$important")
+	d.checkAddRule(t, "||192.0.2.0/24^$important")
+	d.checkAddRule(t, "@@||192.0.2.1/32^$important")
+
+	d.checkMatchEmpty(t, "test.example.org")
+	d.checkMatchEmpty(t, "www.example.com")
+	res, err := d.CheckIP(net.ParseIP("192.0.2.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Reason != NotFilteredWhiteList {
+		t.Errorf("expected 192.0.2.1 to be whitelisted, got %+v", res)
+	}
+
+	// filter priority doesn't change precedence of $important rules
+	d.SetFilterPriority([]uint32{1})
+	d.checkMatchEmpty(t, "test.example.org")
+}
+
+func TestFeatures(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	expected := FeatureState{
+		FilteringEnabled:   true,
+		SafeBrowsingServer: defaultSafebrowsingServer,
+		ParentalServer:     defaultParentalServer,
+		HTTPTimeout:        defaultHTTPTimeout,
+	}
+	if state := d.Features(); state != expected {
+		t.Errorf("expected default features %+v, got %+v", expected, state)
+	}
+
+	d.EnableSafeSearch()
+	err := d.EnableParental(13)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.SetParentalServer("parental.example.org")
+	d.SetHTTPTimeout(time.Second)
+	expected.SafeSearchEnabled = true
+	expected.ParentalEnabled = true
+	expected.ParentalSensitivity = 13
+	expected.ParentalServer = "parental.example.org"
+	expected.HTTPTimeout = time.Second
+	if state := d.Features(); state != expected {
+		t.Errorf("expected features %+v, got %+v", expected, state)
+	}
+
+	d.DisableParental()
+	d.SetEnabled(false)
+	expected.ParentalEnabled = false
+	expected.ParentalSensitivity = 0
+	expected.FilteringEnabled = false
+	if state := d.Features(); state != expected {
+		t.Errorf("expected features %+v, got %+v", expected, state)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	ids := []uint64{}
+	for i := 0; i < 1000; i++ {
+		rule := fmt.Sprintf("||host%d.example.org^", i)
+		if i%2 == 0 {
+			rule = fmt.Sprintf("/^tracker%dx/", i)
+		}
+		id, err := d.AddRuleID(rule, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	for _, id := range ids[100:] {
+		if !d.RemoveRuleByID(id) {
+			t.Fatalf("failed to remove rule %d", id)
+		}
+	}
+	before := cap(d.blackList.rulesLeftovers)
+
+	d.Compact()
+	if d.Count() != 100 {
+		t.Errorf("expected 100 rules after compaction, got %d", d.Count())
+	}
+	if after := cap(d.blackList.rulesLeftovers); after >= before || after != len(d.blackList.rulesLeftovers) {
+		t.Errorf("expected leftovers capacity to be reduced from %d to %d, got %d", before, len(d.blackList.rulesLeftovers), after)
+	}
+	for i := 0; i < 100; i++ {
+		if i%2 == 0 {
+			d.checkMatch(t, fmt.Sprintf("tracker%dx", i))
+		} else {
+			d.checkMatch(t, fmt.Sprintf("host%d.example.org", i))
+		}
+	}
+	d.checkMatchEmpty(t, "tracker100x")
+	d.checkMatchEmpty(t, "host101.example.org")
+}
+
+func TestUserAgent(t *testing.T) {
+	userAgents := make(chan string, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgents <- r.Header.Get("User-Agent")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+	d := NewForTest()
+	defer d.Destroy()
+	d.EnableSafeBrowsing()
+	d.SetSafeBrowsingServer(ts.Listener.Addr().String())
+
+	d.checkMatchEmpty(t, "example.org")
+	if ua := <-userAgents; ua != defaultUserAgent {
+		t.Errorf("expected default User-Agent %s, got %s", defaultUserAgent, ua)
+	}
+
+	d.SetUserAgent("TestResolver/1.0")
+	d.checkMatchEmpty(t, "example.com")
+	if ua := <-userAgents; ua != "TestResolver/1.0" {
+		t.Errorf("expected configured User-Agent, got %s", ua)
+	}
+
+	err := d.EnableParental(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.SetParentalServer(ts.Listener.Addr().String())
+	d.checkMatchEmpty(t, "example.net")
+	<-userAgents // safebrowsing
+	if ua := <-userAgents; ua != "TestResolver/1.0" {
+		t.Errorf("expected configured User-Agent for parental, got %s", ua)
+	}
+}
+
+func TestAllowlistDomain(t *testing.T) {
+	sb := safeBrowsingTestServer(0, "malware.internal.corp", "malware.example.org")
+	defer sb.Close()
+	d := NewForTest()
+	defer d.Destroy()
+	d.EnableSafeBrowsing()
+	d.SetSafeBrowsingServer(sb.Listener.Addr().String())
+	d.checkAddRule(t, "||ads.internal.corp^$important")
+	d.checkAddRule(t, "||example.net^")
+	d.checkAddRule(t, "@@||example.net^")
+
+	err := d.AddAllowlistDomain("Internal.Corp.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = d.AddAllowlistDomain("internal.corp"); err != nil {
+		t.Errorf("expected adding the same domain again to succeed, got %v", err)
+	}
+	if err = d.AddAllowlistDomain("bad domain"); err != ErrInvalidHost {
+		t.Errorf("expected ErrInvalidHost, got %v", err)
+	}
+
+	for _, host := range []string{"internal.corp", "malware.internal.corp", "ads.internal.corp", "a.b.internal.corp"} {
+		res, err := d.CheckHost(host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Reason != NotFilteredWhiteList {
+			t.Errorf("expected %s to be allowlisted, got %+v", host, res)
+		}
+	}
+	// plain whitelist rules also apply to subdomains
+	res, err := d.CheckHost("www.example.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Reason != NotFilteredWhiteList {
+		t.Errorf("expected www.example.net to be whitelisted, got %+v", res)
+	}
+	d.checkMatch(t, "malware.example.org")
+}
+
+func TestStrictHostValidation(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.checkAddRule(t, "||example.org^")
+
+	hosts := []struct {
+		host  string
+		valid bool
+	}{
+		{"my_host.example.org", false},
+		{"_sip._udp.example.org", true},
+		{"-lead.example.org", false},
+		{"trail-.example.org", false},
+		{"in-the-middle.example.org", true},
+		{strings.Repeat("a", 64) + ".example.org", false},
+		{"пример.example.org", false},
+	}
+	// lenient by default
+	for _, h := range hosts {
+		d.checkMatch(t, h.host)
+	}
+
+	d.SetStrictHostValidation(true)
+	for _, h := range hosts {
+		res, err := d.CheckHost(h.host)
+		if h.valid && (err != nil || !res.IsFiltered) {
+			t.Errorf("expected %s to be valid and filtered, got %+v, %v", h.host, res, err)
+		}
+		if !h.valid && (err != ErrInvalidHost || res.IsFiltered) {
+			t.Errorf("expected %s to be rejected with ErrInvalidHost, got %+v, %v", h.host, res, err)
+		}
+	}
+}
+
+func TestDNSRewriteIPs(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.checkAddRule(t, "||lb.example.org^$dnsrewrite=192.0.2.1")
+	d.checkAddRule(t, "||lb.example.org^$dnsrewrite=192.0.2.2,important")
+	d.checkAddRule(t, "||example.org^$dnsrewrite=192.0.2.3")
+	d.checkAddRule(t, "||lb.example.org^$dnsrewrite=192.0.2.2")
+	d.checkAddRule(t, "||v6.example.org^$dnsrewrite=2001:db8::1")
+	d.checkAddRule(t, "||nx.example.org^$dnsrewrite=NXDOMAIN")
+	d.checkAddRule(t, "@@||allowed.example.org^")
+
+	tests := []struct {
+		host string
+		ips  []string
+	}{
+		// important rule decides, so only important rules contribute
+		{"lb.example.org", []string{"192.0.2.2"}},
+		{"www.example.org", []string{"192.0.2.3"}},
+		{"v6.example.org", []string{"192.0.2.3", "2001:db8::1"}},
+	}
+	for _, test := range tests {
+		res, err := d.CheckHost(test.host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.DNSRewrite == nil || len(res.DNSRewrite.IPs) != len(test.ips) {
+			t.Errorf("expected %s to be rewritten to %v, got %+v", test.host, test.ips, res.DNSRewrite)
+			continue
+		}
+		for i, ip := range test.ips {
+			if res.DNSRewrite.IPs[i].String() != ip {
+				t.Errorf("expected %s to be rewritten to %v, got %v", test.host, test.ips, res.DNSRewrite.IPs)
+			}
+		}
+	}
+	d.checkMatchEmpty(t, "allowed.example.org")
+
+	// addresses are accumulated only if the deciding rule rewrites to an address
+	res, err := d.CheckHost("nx.example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.DNSRewrite == nil || res.DNSRewrite.RCode != 3 || len(res.DNSRewrite.IPs) != 0 {
+		t.Errorf("expected nx.example.org to be rewritten to NXDOMAIN, got %+v", res.DNSRewrite)
+	}
+
+	rr := NewForTest()
+	defer rr.Destroy()
+	for _, ip := range []string{"198.51.100.1", "198.51.100.2", "198.51.100.3"} {
+		rr.checkAddRule(t, "||rr.example.org^$dnsrewrite="+ip)
+	}
+	res, err = rr.CheckHost("rr.example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.DNSRewrite == nil || len(res.DNSRewrite.IPs) != 3 || res.DNSRewrite.RCode != 0 {
+		t.Errorf("expected rr.example.org to be rewritten to 3 addresses, got %+v", res.DNSRewrite)
+	}
+}
+
+func TestBlockAll(t *testing.T) {
+	for _, blockAll := range []string{"*", "||*^"} {
+		d := NewForTest()
+		d.checkAddRule(t, blockAll)
+		d.checkAddRule(t, "@@||allowed.example.org^")
+		d.checkAddRule(t, "@@||corp.example^")
+		d.checkAddRule(t, "||ads.corp.example^$important")
+		d.checkAddRule(t, "||nx.example.com^$dnsrewrite=NXDOMAIN")
+
+		d.checkMatch(t, "example.org")
+		d.checkMatch(t, "random-host.net")
+		d.checkMatchEmpty(t, "allowed.example.org")
+		d.checkMatchEmpty(t, "www.corp.example")
+		d.checkMatch(t, "ads.corp.example")
+		// more specific blocking rules are checked first
+		res, err := d.CheckHost("nx.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.DNSRewrite == nil || res.DNSRewrite.RCode != 3 {
+			t.Errorf("expected nx.example.com to be rewritten by its own rule with %s, got %+v", blockAll, res)
+		}
+		if count, _ := d.RegexStats(); count != 0 {
+			t.Errorf("expected %s to not need regexp, got %d regex rules", blockAll, count)
+		}
+		d.Destroy()
+	}
+
+	d := NewForTest()
+	defer d.Destroy()
+	d.SetAllowRegexRules(false)
+	d.checkAddRule(t, "*$dnsclass=CH")
+	d.checkAddRule(t, "@@*")
+	d.checkMatchEmpty(t, "example.org")
+}
+
+func TestNextRefreshTime(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	list := "! Title: Test list\n! Expires: 2 days (update frequency)\n||example.org^\n" +
+		"! Filter ID: 2\n! Expires: 12 hours\n||example.com^\n" +
+		"! Filter ID: 3\n||example.net^\n"
+	before := time.Now()
+	_, err := d.LoadRules(strings.NewReader(list), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta, ok := d.FilterMeta(1)
+	if !ok || meta.Title != "Test list" || meta.Expires != 48*time.Hour || meta.LoadedAt.Before(before) {
+		t.Errorf("unexpected metadata of filter 1: %+v", meta)
+	}
+	next, ok := d.NextRefreshTime(1)
+	if !ok || next.Sub(before) < 48*time.Hour || next.Sub(before) > 48*time.Hour+time.Minute {
+		t.Errorf("expected filter 1 to be refreshed in 2 days, got %s", next)
+	}
+	next, ok = d.NextRefreshTime(2)
+	if !ok || next.Sub(before) < 12*time.Hour || next.Sub(before) > 12*time.Hour+time.Minute {
+		t.Errorf("expected filter 2 to be refreshed in 12 hours, got %s", next)
+	}
+	if _, ok = d.NextRefreshTime(3); ok {
+		t.Errorf("expected no refresh time for filter without expiry")
+	}
+	if _, ok = d.NextRefreshTime(4); ok {
+		t.Errorf("expected no refresh time for filter that wasn't loaded")
+	}
+}
+
+func TestStatsSnapshotRace(t *testing.T) {
+	sb := safeBrowsingTestServer(0, "wmconvirus.narod.ru")
+	defer sb.Close()
+	d := NewForTest()
+	defer d.Destroy()
+	d.SetSafeBrowsingServer(sb.Listener.Addr().String())
+	d.EnableSafeBrowsing()
+
+	before := d.StatsSnapshot()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			d.CheckHost(fmt.Sprintf("host%d.example.org", i))
+			d.StatsSnapshot()
+		}(i)
+	}
+	wg.Wait()
+
+	after := d.StatsSnapshot()
+	lookups := (after.Safebrowsing.Requests - before.Safebrowsing.Requests) + (after.Safebrowsing.CacheHits - before.Safebrowsing.CacheHits)
+	if lookups < 20 {
+		t.Errorf("expected at least 20 safebrowsing lookups to be counted, got %d", lookups)
+	}
+	if after.Safebrowsing.Pending != 0 {
+		t.Errorf("expected no pending requests, got %d", after.Safebrowsing.Pending)
+	}
+}
+
+var publishTestRun int // number of TestPublishExpvar runs
+
+func TestPublishExpvar(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.checkAddRule(t, "||example.org^")
+	d.checkAddRule(t, "@@||www.example.org^")
+	d.checkMatch(t, "example.org")
+	d.checkMatch(t, "ads.example.org")
+	d.checkMatchEmpty(t, "www.example.org")
+	d.checkMatchEmpty(t, "example.com")
+
+	// expvar names can't be reused, so they have to differ when the test is run several times
+	publishTestRun++
+	name := fmt.Sprintf("dnsfilter_test_publish_%d", publishTestRun)
+	err := d.PublishExpvar(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = d.PublishExpvar(name); err != ErrExpvarExists {
+		t.Errorf("expected ErrExpvarExists for the second call, got %v", err)
+	}
+
+	// only one of concurrent calls publishes the name
+	var (
+		wg        sync.WaitGroup
+		published int32
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if d.PublishExpvar(name+"_concurrent") == nil {
+				atomic.AddInt32(&published, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if published != 1 {
+		t.Errorf("expected the name to be published once, got %d", published)
+	}
+
+	var vars struct {
+		Rules  int               `json:"rules"`
+		Checks map[string]uint64 `json:"checks"`
+	}
+	err = json.Unmarshal([]byte(expvar.Get(name).String()), &vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vars.Rules != 2 {
+		t.Errorf("expected 2 rules, got %d", vars.Rules)
+	}
+	if vars.Checks["FilteredBlackList"] != 2 || vars.Checks["NotFilteredWhiteList"] != 1 || vars.Checks["NotFilteredNotFound"] != 1 {
+		t.Errorf("unexpected checks by reason %v", vars.Checks)
+	}
+
+	// variable is evaluated on each read
+	d.checkMatch(t, "example.org")
+	json.Unmarshal([]byte(expvar.Get(name).String()), &vars)
+	if vars.Checks["FilteredBlackList"] != 3 {
+		t.Errorf("expected published counters to be updated, got %v", vars.Checks)
+	}
+}
+
+func TestMonitorMode(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.checkAddRule(t, "||example.org^")
+	d.checkAddRule(t, "@@||allowed.example.org^")
+	var events []MatchEvent
+	d.SetMatchHook(func(e MatchEvent) { events = append(events, e) })
+	d.SetMonitorMode(true)
+
+	ret, err := d.CheckHost("example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret.IsFiltered {
+		t.Errorf("expected example.org not to be filtered in monitor mode, got %+v", ret)
+	}
+	if d.WouldBlock() != 1 {
+		t.Errorf("expected would block counter to be 1, got %d", d.WouldBlock())
+	}
+	if len(events) != 1 || !events[0].Result.IsFiltered || events[0].Rule != "||example.org^" {
+		t.Errorf("expected match hook to get the real verdict, got %+v", events)
+	}
+
+	d.checkMatchEmpty(t, "allowed.example.org")
+	d.checkMatchEmpty(t, "example.com")
+	if d.WouldBlock() != 1 {
+		t.Errorf("expected not filtered hosts not to be counted, got %d", d.WouldBlock())
+	}
+
+	d.SetMonitorMode(false)
+	d.checkMatch(t, "example.org")
+	if d.WouldBlock() != 1 {
+		t.Errorf("expected would block counter not to change with monitor mode off, got %d", d.WouldBlock())
+	}
+}
+
+func TestCustomModifiers(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.SetStrictModifiers(true)
+	if err := d.AddRule("||example.org^$media,important", 0); err != ErrUnknownModifier {
+		t.Errorf("expected ErrUnknownModifier, got %v", err)
+	}
+	if err := d.AddRule("||example.net^$mp4", 0); err != ErrUnknownModifier {
+		t.Errorf("expected ErrUnknownModifier, got %v", err)
+	}
+
+	d.SetIgnoredModifiers([]string{"media", "popup"})
+	d.SetAcceptedModifiers([]string{"$mp4"})
+	if err := d.AddRule("||example.com^$csp=script-src", 0); err != ErrUnknownModifier {
+		t.Errorf("expected csp not to be ignored with custom list, got %v", err)
+	}
+	d.SetStrictModifiers(false)
+	d.checkAddRule(t, "||example.org^$media,important")
+	d.checkAddRule(t, "||example.net^$mp4")
+	d.checkAddRuleFail(t, "||example.com^$media")
+
+	d.checkMatch(t, "example.org")
+	d.checkMatch(t, "example.net")
+	d.checkMatchEmpty(t, "example.com")
+
+	d.SetIgnoredModifiers(nil)
+	d.checkAddRule(t, "||example.info^$csp=script-src,important")
+}
+
+func TestWhitelistBlacklistCount(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	for _, rule := range whitelistRules {
+		d.checkAddRule(t, rule)
+	}
+	if d.WhitelistCount() != 1 || d.BlacklistCount() != 1 {
+		t.Errorf("expected 1 whitelist and 1 blacklist rule, got %d and %d", d.WhitelistCount(), d.BlacklistCount())
+	}
+
+	d.checkAddRule(t, "@@||important.example.org^$important")
+	id, err := d.AddRuleID("||example.com^$important", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.checkAddRuleFail(t, "||example.org^")
+	if d.WhitelistCount() != 2 || d.BlacklistCount() != 2 {
+		t.Errorf("expected 2 whitelist and 2 blacklist rules, got %d and %d", d.WhitelistCount(), d.BlacklistCount())
+	}
+	d.RemoveRuleByID(id)
+	if d.WhitelistCount()+d.BlacklistCount() != d.Count() || d.BlacklistCount() != 1 {
+		t.Errorf("expected counts to add up to %d after removal, got %d and %d", d.Count(), d.WhitelistCount(), d.BlacklistCount())
+	}
+	if c := d.Clone(); c.WhitelistCount() != 2 || c.BlacklistCount() != 1 {
+		t.Errorf("expected clone to have the same counts, got %d and %d", c.WhitelistCount(), c.BlacklistCount())
+	}
+	d.RemoveAllRules()
+	if d.WhitelistCount() != 0 || d.BlacklistCount() != 0 {
+		t.Errorf("expected no rules after reset, got %d and %d", d.WhitelistCount(), d.BlacklistCount())
+	}
+}
+
+func TestRuleCountsAddUp(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.checkAddRule(t, "||example.org^")
+	d.checkAddRule(t, "||example.com^$important")
+	d.checkAddRule(t, "@@||www.example.org^")
+	d.checkAddRule(t, "||example.org^$badfilter")
+	id, err := d.AddRuleID("@@||www.example.org^$badfilter", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(d *Dnsfilter, whitelist, blacklist, badfilter int) {
+		t.Helper()
+		if d.WhitelistCount() != whitelist || d.BlacklistCount() != blacklist || d.BadfilterCount() != badfilter {
+			t.Errorf("expected %d whitelist, %d blacklist and %d $badfilter rules, got %d, %d and %d",
+				whitelist, blacklist, badfilter, d.WhitelistCount(), d.BlacklistCount(), d.BadfilterCount())
+		}
+		if d.WhitelistCount()+d.BlacklistCount()+d.BadfilterCount() != d.Count() {
+			t.Errorf("expected counts to add up to %d", d.Count())
+		}
+	}
+	check(d, 1, 2, 2)
+	c := d.Clone()
+	defer c.Destroy()
+	check(c, 1, 2, 2)
+	d.RemoveRuleByID(id)
+	check(d, 1, 2, 1)
+	d.RemoveAllRules()
+	check(d, 0, 0, 0)
+}
+
+func TestIsWhitelisted(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.checkAddRule(t, "||example.org^")
+	d.checkAddRule(t, "@@||test.example.org")
+	d.checkAddRule(t, "||important.example.org^$important")
+	if err := d.AddAllowlistDomain("allowed.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, host := range []string{"test.example.org", "sub.test.example.org", "TEST.example.org.", "allowed.com", "www.allowed.com"} {
+		if !d.IsWhitelisted(host) {
+			t.Errorf("expected %s to be whitelisted", host)
+		}
+	}
+	for _, host := range []string{"example.org", "important.example.org", "other.com", "", "inv@lid"} {
+		if d.IsWhitelisted(host) {
+			t.Errorf("expected %s not to be whitelisted", host)
+		}
+	}
+}
+
+func TestIDNANormalization(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	// without normalization Unicode rules don't match punycoded queries
+	d.checkAddRule(t, "/^пример\\.рф/")
+	d.checkMatchEmpty(t, "xn--e1afmkfd.xn--p1ai")
+	d.RemoveAllRules()
+
+	d.SetIDNANormalization(true)
+	d.checkAddRule(t, "/^пример\\.рф/")
+	d.checkAddRule(t, "||тест.рф^")
+	d.checkAddRule(t, "||при*р.рус^")
+	d.checkAddRule(t, "||длинныйпример*тест.рф^")
+	d.checkMatch(t, "xn--e1afmkfd.xn--p1ai")
+	d.checkMatch(t, "пример.рф")
+	d.checkMatch(t, "ПРИМЕР.РФ")
+	d.checkMatch(t, "xn--e1aybc.xn--p1ai")
+	d.checkMatch(t, "www.тест.рф")
+	d.checkMatch(t, "пример.рус")
+	d.checkMatch(t, "xn--e1afmkfd.xn--p1acf")
+	d.checkMatch(t, "длинныйпримертест.рф")
+	d.checkMatchEmpty(t, "xn--e1afmkfd.com")
+
+	if got := punycodeRule("@@||пример.рф^"); got != "@@||xn--e1afmkfd.xn--p1ai^" {
+		t.Errorf("unexpected punycode rule: %s", got)
+	}
+	if got := punycodeRule("||при*р.рф^"); got != "||при*р.рф^" {
+		t.Errorf("expected rule with wildcard in Unicode label to stay as is, got %s", got)
+	}
+}
+
+func TestLoadFilterURLRetry(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch n := atomic.AddInt32(&requests, 1); {
+		case r.URL.Path == "/missing.txt":
+			http.NotFound(w, r)
+		case n <= 2 || r.URL.Path == "/broken.txt":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			fmt.Fprintln(w, "||example.org^\n||example.com^")
+		}
+	}))
+	defer ts.Close()
+	d := NewForTest()
+	defer d.Destroy()
+	d.SetFilterFetchRetry(3, 10*time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := d.LoadFilterURL(ctx, ts.URL+"/list.txt", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Added != 2 || atomic.LoadInt32(&requests) != 3 {
+		t.Errorf("expected 2 rules to be added after 3 requests, got %d rules after %d requests", result.Added, requests)
+	}
+	d.checkMatch(t, "example.org")
+
+	atomic.StoreInt32(&requests, 0)
+	_, err = d.LoadFilterURL(ctx, ts.URL+"/missing.txt", 2)
+	if fetchErr, ok := err.(*FilterFetchError); !ok || fetchErr.StatusCode != http.StatusNotFound {
+		t.Errorf("expected FilterFetchError with status 404, got %v", err)
+	}
+	if atomic.LoadInt32(&requests) != 1 {
+		t.Errorf("expected 4xx not to be retried, got %d requests", requests)
+	}
+
+	atomic.StoreInt32(&requests, 0)
+	_, err = d.LoadFilterURL(ctx, ts.URL+"/broken.txt", 3)
+	if fetchErr, ok := err.(*FilterFetchError); !ok || fetchErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected FilterFetchError with status 503, got %v", err)
+	}
+	if atomic.LoadInt32(&requests) != 3 {
+		t.Errorf("expected 3 attempts, got %d requests", requests)
+	}
+}
+
+func TestDiffReplaceRules(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	rules := make([]string, 1000)
+	for i := range rules {
+		rules[i] = fmt.Sprintf("||host%d.example.org^", i)
+	}
+	added, removed, err := d.DiffReplaceRules(1, rules)
+	if err != nil || added != 1000 || removed != 0 {
+		t.Fatalf("expected 1000 rules to be added, got %d added, %d removed, %v", added, removed, err)
+	}
+	// IDs are assigned in the order of the list
+	for i := 1; i < len(rules); i++ {
+		prev, _ := d.GetRule(rules[i-1])
+		info, _ := d.GetRule(rules[i])
+		if info.ID != prev.ID+1 {
+			t.Fatalf("expected rule %s to be added right after %s", rules[i], rules[i-1])
+		}
+	}
+	d.checkAddRule(t, "||other.example.org^")
+	d.checkMatch(t, "host1.example.org")
+	ids := map[string]uint64{}
+	for _, info := range d.Rules(1) {
+		ids[info.Text] = info.ID
+	}
+
+	rules[500] = "||changed.example.org^"
+	added, removed, err = d.DiffReplaceRules(1, append(rules, "! comment", "||host1.example.org^"))
+	if err != nil || added != 1 || removed != 1 {
+		t.Errorf("expected 1 rule to be added and 1 removed, got %d added, %d removed, %v", added, removed, err)
+	}
+	if d.CountByFilter(1) != 1000 || d.Count() != 1001 {
+		t.Errorf("expected 1000 rules in the list and 1001 in total, got %d and %d", d.CountByFilter(1), d.Count())
+	}
+	d.checkMatch(t, "changed.example.org")
+	d.checkMatchEmpty(t, "host500.example.org")
+	d.checkMatch(t, "other.example.org")
+	hits := d.RuleHits()
+	for _, info := range d.Rules(1) {
+		if info.Text != "||changed.example.org^" && ids[info.Text] != info.ID {
+			t.Errorf("expected rule %s to keep its ID", info.Text)
+		}
+		if info.Text == "||host1.example.org^" && hits[info.ID] != 1 {
+			t.Errorf("expected rule %s to keep its hit counter, got %d", info.Text, hits[info.ID])
+		}
+	}
+}
+
+func TestSeparatorClass(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.checkAddRule(t, "|ads^")
+	d.checkMatch(t, "ads")
+	d.checkMatchEmpty(t, "ads-server.example.org")
+
+	for _, class := range []string{"[_-", "ab", ".*"} {
+		if err := d.SetSeparatorClass(class); err != ErrInvalidSeparatorClass {
+			t.Errorf("expected separator class %s to be rejected, got %v", class, err)
+		}
+	}
+	if err := d.SetSeparatorClass("[_-]"); err != nil {
+		t.Fatal(err)
+	}
+	d.checkAddRule(t, "|tracker^")
+	d.checkAddRule(t, "||example.com^")
+	d.checkMatch(t, "tracker-1.example.org")
+	d.checkMatch(t, "tracker_2.example.org")
+	d.checkMatch(t, "tracker")
+	d.checkMatchEmpty(t, "trackers.example.org")
+	d.checkMatchEmpty(t, "tracker.example.org")
+	// domain rules are matched by domain, so their ^ still means end of hostname
+	d.checkMatch(t, "www.example.com")
+	d.checkMatchEmpty(t, "example.com-cdn.net")
+	// rules added before the call are not affected
+	d.checkMatchEmpty(t, "ads-server.example.org")
+
+	if converted, _ := ruleToRegexp("|tracker^", "[_-]"); converted != `^tracker(?:[_-]|$)` {
+		t.Errorf("unexpected regexp: %s", converted)
+	}
+}
+
+func TestAddRulesFunc(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+
+	rules := make(chan string)
+	go func() {
+		for i := 0; i < 25000; i++ {
+			rules <- fmt.Sprintf("||host%d.example.org^", i)
+		}
+		rules <- "! comment"
+		rules <- "||host0.example.org^"
+		close(rules)
+	}()
+	calls := []int{}
+	added, err := d.AddRulesFunc(rules, 1, func(done int) {
+		calls = append(calls, done)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 25000 {
+		t.Errorf("expected 25000 rules to be added, got %d", added)
+	}
+	if !reflect.DeepEqual(calls, []int{10000, 20000, 25002}) {
+		t.Errorf("unexpected progress calls %v", calls)
+	}
+	d.checkMatch(t, "host24999.example.org")
+}
+
+func TestMaxRules(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.SetMaxRules(100)
+	file, err := os.Open("../tests/dns.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	result, err := d.LoadRules(file, 1)
+	if err != ErrRuleLimitExceeded {
+		t.Fatalf("expected ErrRuleLimitExceeded, got %v", err)
+	}
+	if result.Added != 100 || d.Count() != 100 {
+		t.Errorf("expected exactly 100 rules to be loaded, got %d, %d", result.Added, d.Count())
+	}
+	if err := d.AddRule("||example.org^", 2); err != ErrRuleLimitExceeded {
+		t.Errorf("expected ErrRuleLimitExceeded, got %v", err)
+	}
+
+	d.SetMaxRules(0)
+	id, err := d.AddRuleID("||example.org^", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// rejected rules don't use up IDs
+	if id != 101 {
+		t.Errorf("expected rule to get ID 101, got %d", id)
+	}
+}
+
+func TestSkipLog(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	type skip struct {
+		line   int
+		rule   string
+		reason string
+	}
+	skipped := []skip{}
+	d.SetSkipLog(func(lineNo int, rule, reason string) {
+		skipped = append(skipped, skip{lineNo, rule, reason})
+	})
+
+	list := strings.Join([]string{
+		"! Title: mixed list",
+		"||example.org^",
+		"example.org##.banner",
+		"",
+		"# hosts comment",
+		"||popup.example.org^$popup",
+		"##.ad",
+		"/ads[/",
+		"||example.org^",
+		"||example.com^$dnsrewrite=bad",
+		"||example.net^",
+	}, "\n")
+	result, err := d.LoadRules(strings.NewReader(list), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Added != 2 {
+		t.Errorf("expected 2 rules to be added, got %d", result.Added)
+	}
+
+	expected := []int{3, 6, 7, 8, 9, 10}
+	if len(skipped) != len(expected) {
+		t.Fatalf("expected lines %v to be skipped, got %+v", expected, skipped)
+	}
+	for i, s := range skipped {
+		if s.line != expected[i] || s.reason == "" {
+			t.Errorf("expected line %d to be skipped with a reason, got %+v", expected[i], s)
+		}
+	}
+	if skipped[1].rule != "||popup.example.org^$popup" || !strings.Contains(skipped[1].reason, "popup") {
+		t.Errorf("unexpected skip %+v", skipped[1])
+	}
+	if !strings.Contains(skipped[3].reason, "regexp") {
+		t.Errorf("unexpected skip %+v", skipped[3])
+	}
+
+	rules := d.SkippedRules()
+	if len(rules) != 1 || rules[0].Line != 6 {
+		t.Errorf("expected skipped rule to have line number, got %+v", rules)
+	}
+}
+
+func TestLoadRulesDuration(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	file, err := os.Open("../tests/dns.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	result, err := d.LoadRules(file, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Added == 0 || result.Duration <= 0 || result.RulesPerSecond <= 0 {
+		t.Errorf("expected load duration and throughput to be reported, got %+v", result)
+	}
+	trace("Loaded %d rules in %s, %.0f rules per second\n", result.Added, result.Duration, result.RulesPerSecond)
+}
+
+func TestFastPassDomains(t *testing.T) {
+	var requests int32
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusNoContent)
+	}
+	sb := httptest.NewServer(http.HandlerFunc(handler))
+	defer sb.Close()
+	pc := httptest.NewServer(http.HandlerFunc(handler))
+	defer pc.Close()
+	d := NewForTest()
+	defer d.Destroy()
+	d.SetSafeBrowsingServer(sb.Listener.Addr().String())
+	d.SetParentalServer(pc.Listener.Addr().String())
+	d.EnableSafeBrowsing()
+	if err := d.EnableParental(3); err != nil {
+		t.Fatal(err)
+	}
+	d.checkAddRule(t, "||example.org^")
+	d.checkAddRule(t, "||example.com^")
+	var events int
+	d.SetMatchHook(func(MatchEvent) { events++ })
+
+	err := d.LoadFastPassDomains(strings.NewReader("# top sites\n1,example.org\nclean.example.net.\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.checkMatchEmpty(t, "example.org")
+	d.checkMatchEmpty(t, "Clean.Example.Net")
+	if n := atomic.LoadInt32(&requests); n != 0 || events != 0 {
+		t.Errorf("expected fast-pass hosts to skip all checks, got %d lookups and %d match events", n, events)
+	}
+
+	d.checkMatch(t, "www.example.org")
+	d.checkMatch(t, "example.com")
+	d.checkMatchEmpty(t, "other.example.net")
+	if atomic.LoadInt32(&requests) == 0 {
+		t.Errorf("expected other hosts to be looked up")
+	}
+}
+
+func TestEndAnchor(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	tests := []struct {
+		rule    string
+		host    string
+		matched bool
+	}{
+		{"|example.org|", "example.org", true},
+		{"|example.org|", "www.example.org", false},
+		{"|example.org|", "example.org.uk", false},
+		{"|example.org", "example.org.uk", true},
+		{"||example.org^|", "example.org", true},
+		{"||example.org^|", "www.example.org", true},
+		{"||example.org^|", "example.org.uk", false},
+		{"||example.org|", "www.example.org", true},
+		{"||example.org|", "example.org.uk", false},
+		{"||example.org", "example.org.uk", true},
+		{"|example.org^|", "example.org", true},
+		{"|example.org^|", "example.org.uk", false},
+	}
+	for _, test := range tests {
+		matched, err := d.MatchRule(test.rule, test.host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if matched != test.matched {
+			t.Errorf("expected rule %s to match %s: %v, got %v", test.rule, test.host, test.matched, matched)
+		}
+	}
+
+	for _, rule := range []string{"|||example.org", "||example.org||", "|example.org||", "@@||example.org^||"} {
+		d.checkAddRuleFail(t, rule)
+	}
+}
+
+func TestResultJSON(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.checkAddRule(t, "||example.org^$dnsrewrite=192.0.2.1")
+	if err := d.AddRule("||example.com^", 7); err != nil {
+		t.Fatal(err)
+	}
+	rewrite, err := d.CheckHost("example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocked, err := d.CheckHost("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blocked.FilterID != 7 {
+		t.Errorf("expected filter ID 7, got %d", blocked.FilterID)
+	}
+
+	for _, result := range []Result{rewrite, blocked, {IsFiltered: true, Reason: FilteredSafeBrowsing, ThreatType: ThreatPhishing}, {IsFiltered: true, Reason: FilteredParental, Category: "PORN"}} {
+		data, err := json.Marshal(result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), `"Reason":"`+result.Reason.String()+`"`) {
+			t.Errorf("expected reason to be encoded as a string, got %s", data)
+		}
+		decoded := Result{}
+		if err = json.Unmarshal(data, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if result.DNSRewrite != nil {
+			// IPv4 addresses are decoded in 16-byte form
+			if decoded.DNSRewrite == nil || !sameRewrite(decoded.DNSRewrite, result.DNSRewrite) {
+				t.Errorf("expected rewrite %+v after round trip, got %+v", result.DNSRewrite, decoded.DNSRewrite)
+			}
+			result.DNSRewrite, decoded.DNSRewrite = nil, nil
+		}
+		if !reflect.DeepEqual(decoded, result) {
+			t.Errorf("expected %+v after round trip, got %+v", result, decoded)
+		}
+	}
+
+	decoded := Result{}
+	if err = json.Unmarshal([]byte(`{"IsFiltered":true,"Reason":3}`), &decoded); err != nil || decoded.Reason != FilteredBlackList {
+		t.Errorf("expected numeric reason to be decoded, got %v, %v", decoded.Reason, err)
+	}
+	if err = json.Unmarshal([]byte(`{"Reason":"Unknown"}`), &decoded); err == nil {
+		t.Errorf("expected unknown reason to fail")
+	}
+}
+
+func TestLoadRulesBOM(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	list := "\ufeff||example.org^\r\n||exa\x00mple.com^\r\n\x00\n||example.net^\n"
+	result, err := d.LoadRules(strings.NewReader(list), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Added != 3 {
+		t.Errorf("expected 3 rules to be added, got %d", result.Added)
+	}
+	d.checkMatch(t, "example.org")
+	d.checkMatch(t, "example.com")
+	d.checkMatch(t, "example.net")
+}
+
+func TestLoadRulesCounts(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	list := `! Title: crafted list
+||example.org^
+example.com##.banner
+##.ad-block
+example.net#@#.sponsored
+example.org$$script[data-src="ads.js"]
+||ads.example.com^$dnsrewrite=garbage
+/tracker[0-9/
+||tracker.net^
+||example.org^
+||mail.example.com^$protocol=smtp
+`
+	result, err := d.LoadRules(strings.NewReader(list), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Added != 2 || result.Skipped != 4 || len(result.Errors) != 3 {
+		t.Fatalf("expected 2 added, 4 skipped and 3 invalid rules, got %d, %d and %v", result.Added, result.Skipped, result.Errors)
+	}
+	first := result.Errors[0]
+	if first.Line != 7 || first.Text != "||ads.example.com^$dnsrewrite=garbage" || first.Unwrap() != ErrInvalidDNSRewrite {
+		t.Errorf("unexpected error for invalid $dnsrewrite %+v", first)
+	}
+	if result.Errors[1].Line != 8 || result.Errors[1].Err == nil {
+		t.Errorf("unexpected error for broken regexp %+v", result.Errors[1])
+	}
+	if result.Errors[2].Line != 11 || result.Errors[2].Err != ErrInvalidSyntax {
+		t.Errorf("unexpected error for unknown protocol %+v", result.Errors[2])
+	}
+}
+
+func TestLoadMixedHostsAndAdblock(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	list := `! mixed list
+127.0.0.1 localhost
+0.0.0.0 ads.com
+||tracker.net^
+127.0.0.1 banner.org popup.org # two hosts
+192.168.1.10 router.lan
+@@||good.ads.com^
+::1
+`
+	result, err := d.LoadRules(strings.NewReader(list), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Added != 6 {
+		t.Errorf("expected 6 rules to be added, got %d", result.Added)
+	}
+	// IP without hostnames is not a hosts entry, so it's reported by the rule parser
+	if len(result.Errors) != 1 || result.Errors[0].Line != 8 || result.Errors[0].Text != "::1" {
+		t.Errorf("expected bare IP to be reported as invalid, got %v", result.Errors)
+	}
+	d.checkMatch(t, "ads.com")
+	d.checkMatch(t, "sub.ads.com")
+	d.checkMatch(t, "tracker.net")
+	d.checkMatch(t, "banner.org")
+	d.checkMatch(t, "popup.org")
+	d.checkMatchEmpty(t, "good.ads.com")
+	d.checkMatchEmpty(t, "localhost")
+
+	ret, err := d.CheckHost("router.lan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret.DNSRewrite == nil || len(ret.DNSRewrite.IPs) != 1 || !ret.DNSRewrite.IPs[0].Equal(net.ParseIP("192.168.1.10")) {
+		t.Errorf("expected router.lan to be rewritten to 192.168.1.10, got %+v", ret)
+	}
+}
+
+func TestRuleSetHash(t *testing.T) {
+	rules := []string{"||example.org^", "@@||www.example.org^", "/ads[0-9]+\\.com/", "||tracker.net^$important"}
+	d1 := NewForTest()
+	defer d1.Destroy()
+	d2 := NewForTest()
+	defer d2.Destroy()
+	for i := range rules {
+		d1.checkAddRule(t, rules[i])
+		d2.checkAddRule(t, rules[len(rules)-1-i])
+	}
+	hash := d1.RuleSetHash()
+	if hash != d2.RuleSetHash() {
+		t.Errorf("expected the same hash regardless of insertion order")
+	}
+	if hash != d1.RuleSetHash() {
+		t.Errorf("expected hash to be stable")
+	}
+
+	id, err := d1.AddRuleID("||another.org^", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash = d1.RuleSetHash()
+	if hash == d2.RuleSetHash() {
+		t.Errorf("expected hash to change after a rule is added")
+	}
+
+	// the same rule in another filter list
+	if err = d2.AddRule("||another.org^", 1); err != nil {
+		t.Fatal(err)
+	}
+	if d2.RuleSetHash() == hash {
+		t.Errorf("expected hash to depend on filter list IDs")
+	}
+
+	d1.DisableRuleByID(id)
+	if d1.RuleSetHash() == hash {
+		t.Errorf("expected hash to change after a rule is disabled")
+	}
+	d1.EnableRuleByID(id)
+	if d1.RuleSetHash() != hash {
+		t.Errorf("expected hash to be restored after the rule is enabled again")
+	}
+}
+
+func TestCheckHostStream(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.checkAddRule(t, "||example.org^")
+	d.checkAddRule(t, "@@||www.example.org^")
+	results := d.CheckHostStream([]string{"ads.example.org", "example.com", "www.example.org", "exa mple.org", "example.org"})
+	expected := []Reason{FilteredBlackList, NotFilteredNotFound, NotFilteredWhiteList, NotFilteredError, FilteredBlackList}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %d results, got %d", len(expected), len(results))
+	}
+	for i, result := range results {
+		if result.Reason != expected[i] {
+			t.Errorf("expected result %d to be %s, got %s", i, expected[i], result.Reason)
+		}
+	}
+}
+
+func TestNetworkModifier(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.checkAddRule(t, "*$network=10.0.0.0/8")
+	d.checkAddRule(t, "||*^$network=2001:db8::/32")
+	d.checkAddRule(t, "*$network=192.0.2.1")
+	d.checkAddRule(t, "@@*$network=10.1.0.0/16")
+	for _, rule := range []string{"||example.org^$network=10.0.0.0/8", "*$network=10.0.0.0/33", "*$network=example.org", "*$network="} {
+		d.checkAddRuleFail(t, rule)
+	}
+
+	tests := []struct {
+		ip     string
+		reason Reason
+		rule   string
+	}{
+		{"10.2.3.4", FilteredBlackList, "*"},
+		{"10.1.2.3", NotFilteredWhiteList, "*"},
+		{"11.0.0.1", NotFilteredNotFound, ""},
+		{"192.0.2.1", FilteredBlackList, "*"},
+		{"192.0.2.2", NotFilteredNotFound, ""},
+		{"2001:db8::1", FilteredBlackList, "||*^"},
+		{"2001:db9::1", NotFilteredNotFound, ""},
+	}
+	for _, test := range tests {
+		res, err := d.CheckIP(net.ParseIP(test.ip))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Reason != test.reason || res.Rule != test.rule {
+			t.Errorf("expected %s to be %s by %q, got %s by %q", test.ip, test.reason, test.rule, res.Reason, res.Rule)
+		}
+	}
+	// hostnames are not affected
+	d.checkMatchEmpty(t, "example.org")
+}
+
+func TestHTTPClient(t *testing.T) {
+	sb := safeBrowsingTestServer(0, "malware.example.org")
+	defer sb.Close()
+	pc := parentalTestServer("adult.example.org")
+	defer pc.Close()
+	list := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "||ads.example.org^")
+	}))
+	defer list.Close()
+
+	var requests int32
+	client := &http.Client{
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			atomic.AddInt32(&requests, 1)
+			return http.DefaultTransport.RoundTrip(req)
+		}),
+		Timeout: 7 * time.Second,
+	}
+	d := NewForTest()
+	defer d.Destroy()
+	d.SetHTTPClient(client)
+	d.SetSafeBrowsingServer(sb.Listener.Addr().String())
+	d.SetParentalServer(pc.Listener.Addr().String())
+	d.EnableSafeBrowsing()
+	if err := d.EnableParental(3); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.LoadFilterURL(context.Background(), list.URL, 0); err != nil {
+		t.Fatal(err)
+	}
+	d.checkMatch(t, "ads.example.org")
+	d.checkMatch(t, "malware.example.org")
+	d.checkMatch(t, "adult.example.org")
+	// list download, and safebrowsing and parental lookups for malware.example.org and adult.example.org
+	if n := atomic.LoadInt32(&requests); n < 3 {
+		t.Errorf("expected all requests to go through custom client, got %d", n)
+	}
+
+	d.SetHTTPTimeout(time.Second)
+	if client.Timeout != 7*time.Second || d.Features().HTTPTimeout != 7*time.Second {
+		t.Errorf("expected timeout of custom client not to be changed, got %s", d.Features().HTTPTimeout)
+	}
+	d.SetHTTPClient(nil)
+	if d.Features().HTTPTimeout != time.Second {
+		t.Errorf("expected internal client to be used again, got timeout %s", d.Features().HTTPTimeout)
+	}
+}
+
+func TestSubdomainsOnly(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.checkAddRule(t, "||*.cdn.example.com^")
+	d.checkAddRule(t, "||*.example.org^$maxlabels=1")
+	d.checkMatch(t, "a.cdn.example.com")
+	d.checkMatch(t, "b.a.cdn.example.com")
+	d.checkMatch(t, "A.CDN.example.com.")
+	d.checkMatchEmpty(t, "cdn.example.com")
+	d.checkMatchEmpty(t, "evilcdn.example.com")
+	d.checkMatchEmpty(t, "example.com")
+	d.checkMatchEmpty(t, "example.org")
+	d.checkMatch(t, "a.b.example.org")
+
+	ret, err := d.CheckHost("a.cdn.example.com")
+	if err != nil || ret.Rule != "||*.cdn.example.com^" {
+		t.Errorf("expected original rule text in result, got %q, %v", ret.Rule, err)
+	}
+	if count, _ := d.RegexStats(); count != 0 {
+		t.Errorf("expected subdomain rules to be matched without regexps, got %d", count)
+	}
+}
+
+func TestFilterIDs(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	if ids := d.FilterIDs(); len(ids) != 0 {
+		t.Errorf("expected no filter IDs, got %v", ids)
+	}
+	for _, id := range []uint32{7, 0, 3, 7} {
+		if err := d.AddRule(fmt.Sprintf("||list%d-%d.example.org^", id, d.Count()), id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	removed, err := d.AddRuleID("||removed.example.org^", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.RemoveRuleByID(removed)
+	if ids := d.FilterIDs(); !reflect.DeepEqual(ids, []uint32{0, 3, 7}) {
+		t.Errorf("expected filter IDs 0, 3 and 7, got %v", ids)
+	}
+	if d.CountByFilter(7) != 2 || d.CountByFilter(5) != 0 {
+		t.Errorf("expected 2 rules in list 7 and none in list 5, got %d and %d", d.CountByFilter(7), d.CountByFilter(5))
+	}
+	if ids := d.Clone().FilterIDs(); !reflect.DeepEqual(ids, []uint32{0, 3, 7}) {
+		t.Errorf("expected clone to have the same filter IDs, got %v", ids)
+	}
+	d.RemoveAllRules()
+	if ids := d.FilterIDs(); len(ids) != 0 {
+		t.Errorf("expected no filter IDs after reset, got %v", ids)
+	}
+}
+
+func TestNoopAndWhitespace(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.checkAddRule(t, "||example.org^  ")
+	d.checkAddRule(t, "||example.net^ $noop")
+	d.checkAddRule(t, "||example.com^$___,important")
+	d.checkAddRule(t, "@@||www.example.com^$important , noop ")
+	result, err := d.LoadRules(strings.NewReader("||example.info^ \t\n||example.biz^$noop\n"), 0)
+	if err != nil || result.Added != 2 {
+		t.Errorf("expected 2 rules to be loaded, got %d, %v", result.Added, err)
+	}
+	d.checkAddRuleFail(t, "  $noop")
+	d.checkAddRuleFail(t, "||example.org^$important,,noop")
+
+	d.checkMatch(t, "example.org")
+	d.checkMatch(t, "example.net")
+	d.checkMatch(t, "example.com")
+	d.checkMatchEmpty(t, "www.example.com")
+	d.checkMatch(t, "example.info")
+	d.checkMatch(t, "example.biz")
+}
+
+func TestUnknownModifiers(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	// unknown modifiers are dropped by default
+	d.checkAddRule(t, "||example.org^$imporant")
+	d.checkAddRule(t, "@@||www.example.org^$imporant")
+	d.checkMatch(t, "example.org")
+	d.checkMatchEmpty(t, "www.example.org")
+
+	// but not the ones that would make the rule broader
+	for _, rule := range []string{"||example.edu^$dnstype=AAAA", "||example.edu^$dnstype=~A", "||example.edu^$ctag=device_phone", "||example.edu^$~ctag=pc"} {
+		if err := d.AddRule(rule, 0); err != ErrUnknownModifier {
+			t.Errorf("expected rule %s to fail with ErrUnknownModifier, got %v", rule, err)
+		}
+	}
+	d.checkMatchEmpty(t, "example.edu")
+
+	d.SetStrictModifiers(true)
+	for _, rule := range []string{"||example.com^$imporant", "||example.net^$important,~thrid-party"} {
+		if err := d.AddRule(rule, 0); err != ErrUnknownModifier {
+			t.Errorf("expected rule %s to fail with ErrUnknownModifier, got %v", rule, err)
+		}
+	}
+	d.checkAddRule(t, "||example.info^$important")
+	d.checkMatchEmpty(t, "example.com")
+	d.checkMatchEmpty(t, "example.net")
+	d.checkMatch(t, "example.info")
+}
+
+func TestKeywordRules(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.checkAddRule(t, "tracker")
+	d.checkMatch(t, "mytrackerthing.com")
+
+	d.SetKeywordRules(true)
+	d.checkAddRule(t, "doubleclick")
+	d.checkAddRule(t, "@@DoubleClick$important,dnsclass=CH")
+	d.checkAddRule(t, "adsrv")
+	d.checkMatch(t, "ad.doubleclick.net")
 	d.checkMatch(t, "doubleclick.net")
-	d.checkMatch(t, "www.doubleclick.net")
-	d.checkMatch(t, "nodoubleclick.net")
-	d.checkMatchEmpty(t, "doubleclick.net.ru")
+	d.checkMatch(t, "www.doubleclick")
+	d.checkMatch(t, "adsrv.adsrvadsrv.example.org")
+	d.checkMatch(t, "xadsrv.adsrv")
+	d.checkMatchEmpty(t, "mydoubleclickthing.com")
+	d.checkMatchEmpty(t, "doubleclicks.net")
+	d.checkMatchEmpty(t, "adsrvadsrv.example.org")
+	// rules added before the call keep substring semantics
+	d.checkMatch(t, "mytrackerthing.com")
+
+	ret, err := d.CheckHostClass("ad.doubleclick.net", 3)
+	if err != nil || ret.Reason != NotFilteredWhiteList {
+		t.Errorf("expected whitelist keyword rule to match, got %s, %v", ret.Reason, err)
+	}
+	if count, _ := d.RegexStats(); count != 1 {
+		t.Errorf("expected keyword rules to be matched without regexps, got %d regexp rules", count)
+	}
 }
 
-func TestCount(t *testing.T) {
+func TestConcurrentAddSameRule(t *testing.T) {
 	d := NewForTest()
 	defer d.Destroy()
-	err := loadTestRules(d)
-	if err != nil {
-		t.Fatal(err)
+	var (
+		wg    sync.WaitGroup
+		added int32
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if d.AddRule("||example.org^", 0) == nil {
+				atomic.AddInt32(&added, 1)
+			}
+		}()
 	}
-	count := d.Count()
-	expected := 12747
-	if count != expected {
-		t.Fatalf("Number of rules parsed should be %d, but it is %d\n", expected, count)
+	wg.Wait()
+	if added != 1 || d.Count() != 1 || len(d.Rules(0)) != 1 {
+		t.Errorf("expected the rule to be added once, got %d successful adds and %d rules", added, d.Count())
 	}
 }
 
-func TestDnsFilterBlocking(t *testing.T) {
+func TestPublicSuffixWildcards(t *testing.T) {
 	d := NewForTest()
 	defer d.Destroy()
-	d.checkAddRule(t, "||example.org^")
+	d.checkAddRule(t, "||ads.*^")
+	// by default it's a mask rule
+	d.checkMatch(t, "ads.legitcompany.com")
 
-	d.checkMatch(t, "example.org")
-	d.checkMatch(t, "test.example.org")
-	d.checkMatch(t, "test.test.example.org")
-	d.checkMatchEmpty(t, "testexample.org")
-	d.checkMatchEmpty(t, "onemoreexample.org")
+	d.RemoveAllRules()
+	d.SetPublicSuffixWildcards(true)
+	d.checkAddRule(t, "||ads.*^")
+	d.checkAddRule(t, "||tracker.example.*^")
+	for _, host := range []string{"ads.com", "ads.net", "ads.co.uk", "www.ads.co.uk", "tracker.example.org", "tracker.example.com.au"} {
+		d.checkMatch(t, host)
+	}
+	for _, host := range []string{"ads.legitcompany.com", "ads.co.uk.example.com", "myads.com", "co.uk", "ads", "example.org", "tracker.example.legit.org"} {
+		d.checkMatchEmpty(t, host)
+	}
+	info, _ := d.GetRule("||ads.*^")
+	if info.IsRegexp {
+		t.Errorf("expected ||ads.*^ to be matched without regexp")
+	}
 }
 
-func TestDnsFilterWhitelist(t *testing.T) {
+func TestResultCache(t *testing.T) {
 	d := NewForTest()
 	defer d.Destroy()
+	d.SetResultCache(100)
 	d.checkAddRule(t, "||example.org^")
-	d.checkAddRule(t, "@@||test.example.org")
 
-	d.checkMatch(t, "example.org")
-	d.checkMatchEmpty(t, "test.example.org")
-	d.checkMatchEmpty(t, "test.test.example.org")
-}
+	d.checkMatch(t, "ads.example.org")
+	d.checkMatchEmpty(t, "example.com")
+	// cached verdicts are the same
+	d.checkMatch(t, "ads.example.org")
+	d.checkMatchEmpty(t, "example.com")
 
-func TestDnsFilterImportant(t *testing.T) {
-	d := NewForTest()
-	defer d.Destroy()
-	d.checkAddRule(t, "@@||example.org^")
-	d.checkAddRule(t, "||test.example.org^$important")
+	d.checkAddRule(t, "||example.com^")
+	d.checkMatch(t, "example.com")
 
-	d.checkMatchEmpty(t, "example.org")
-	d.checkMatch(t, "test.example.org")
-	d.checkMatch(t, "test.test.example.org")
-	d.checkMatchEmpty(t, "testexample.org")
-	d.checkMatchEmpty(t, "onemoreexample.org")
+	id, err := d.AddRuleID("@@||ads.example.org^", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.checkMatchEmpty(t, "ads.example.org")
+	d.DisableRuleByID(id)
+	d.checkMatch(t, "ads.example.org")
+	info, _ := d.GetRule("||example.org^")
+	d.RemoveRuleByID(info.ID)
+	d.checkMatchEmpty(t, "ads.example.org")
+
+	d.RemoveAllRules()
+	d.checkMatchEmpty(t, "example.com")
 }
 
-func TestDnsFilterRegexrule(t *testing.T) {
+func TestGetRule(t *testing.T) {
 	d := NewForTest()
 	defer d.Destroy()
-	d.checkAddRule(t, "/example\\.org/")
-	d.checkAddRule(t, "@@||test.example.org^")
+	if err := d.AddRuleWithComment("@@||example.org^$important", 3, "allowed by support"); err != nil {
+		t.Fatal(err)
+	}
+	id, err := d.AddRuleID("/ads[0-9]+/", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.checkMatchEmpty(t, "www.example.org")
+	d.checkMatchEmpty(t, "example.org")
+	d.DisableRuleByID(id)
 
-	d.checkMatch(t, "example.org")
-	d.checkMatchEmpty(t, "test.example.org")
-	d.checkMatchEmpty(t, "test.test.example.org")
-	d.checkMatch(t, "testexample.org")
-	d.checkMatch(t, "onemoreexample.org")
+	info, ok := d.GetRule("  @@||example.org^$important ")
+	if !ok {
+		t.Fatal("expected rule to be found")
+	}
+	if info.FilterListID != 3 || !info.IsWhitelist || !info.IsImportant || !info.Enabled || info.Comment != "allowed by support" || info.Hits != 2 {
+		t.Errorf("unexpected rule info: %+v", info)
+	}
+	info, ok = d.GetRule("/ads[0-9]+/")
+	if !ok || info.ID != id || info.FilterListID != 5 || !info.IsRegexp || info.Enabled || info.Hits != 0 {
+		t.Errorf("unexpected rule info: %+v", info)
+	}
+	if _, ok = d.GetRule("||example.org^"); ok {
+		t.Errorf("expected rule that wasn't added not to be found")
+	}
 }
 
-func TestDomainMask(t *testing.T) {
+func TestSafeBrowsingProtocol(t *testing.T) {
+	ts := safeBrowsingJSONTestServer("wmconvirus.narod.ru")
+	defer ts.Close()
 	d := NewForTest()
 	defer d.Destroy()
-	d.checkAddRule(t, "test*.example.org^")
-	d.checkAddRule(t, "exam*.com")
+	d.EnableSafeBrowsing()
+	d.SetSafeBrowsingServer(ts.Listener.Addr().String())
 
-	d.checkMatch(t, "test.example.org")
-	d.checkMatch(t, "test2.example.org")
-	d.checkMatch(t, "example.com")
-	d.checkMatch(t, "exampleeee.com")
+	// legacy requests go to a path this server doesn't know
+	d.checkMatchEmpty(t, "wmconvirus.narod.ru")
 
-	d.checkMatchEmpty(t, "example.org")
-	d.checkMatchEmpty(t, "testexample.org")
-	d.checkMatchEmpty(t, "example.co.uk")
+	d.SetSafeBrowsingProtocol(SafeBrowsingJSON)
+	ret, err := d.CheckHost("wmconvirus.narod.ru")
+	if err != nil {
+		t.Fatalf("Error while matching host: %s", err)
+	}
+	if !ret.IsFiltered || ret.Reason != FilteredSafeBrowsing || ret.ThreatType != ThreatPhishing {
+		t.Errorf("Expected wmconvirus.narod.ru to be filtered as phishing, got %+v", ret)
+	}
+	d.checkMatch(t, "test.wmconvirus.narod.ru")
+	d.checkMatchEmpty(t, "yandex.ru")
 }
 
-func TestAddRuleFail(t *testing.T) {
+func TestEnforcedReasons(t *testing.T) {
+	ts := parentalTestServer("pornhub.com")
+	defer ts.Close()
 	d := NewForTest()
 	defer d.Destroy()
-	d.checkAddRuleFail(t, "lkfaojewhoawehfwacoefawr$@#$@3413841384")
-}
+	d.EnableParental(3)
+	d.SetParentalServer(ts.Listener.Addr().String())
+	d.SetBlockingIP(net.IPv4zero, net.IPv6zero)
+	d.checkAddRule(t, "||doubleclick.net^")
+	d.SetEnforcedReasons(MaskOf(FilteredBlackList, FilteredSafeBrowsing))
 
-func TestSafeBrowsing(t *testing.T) {
-	testCases := []string{
-		"",
-		"sb.adtidy.org",
+	ret, err := d.CheckHost("pornhub.com")
+	if err != nil {
+		t.Fatalf("Error while matching host: %s", err)
 	}
-	for _, tc := range testCases {
-		t.Run(fmt.Sprintf("%s in %s", tc, _Func()), func(t *testing.T) {
-			d := NewForTest()
-			defer d.Destroy()
-			d.EnableSafeBrowsing()
-			stats.Safebrowsing.Requests = 0
-			d.checkMatch(t, "wmconvirus.narod.ru")
-			d.checkMatch(t, "wmconvirus.narod.ru")
-			if stats.Safebrowsing.Requests != 1 {
-				t.Errorf("Safebrowsing lookup positive cache is not working: %v", stats.Safebrowsing.Requests)
-			}
-			d.checkMatch(t, "WMconvirus.narod.ru")
-			if stats.Safebrowsing.Requests != 1 {
-				t.Errorf("Safebrowsing lookup positive cache is not working: %v", stats.Safebrowsing.Requests)
-			}
-			d.checkMatch(t, "wmconvirus.narod.ru.")
-			d.checkMatch(t, "test.wmconvirus.narod.ru")
-			d.checkMatch(t, "test.wmconvirus.narod.ru.")
-			d.checkMatchEmpty(t, "yandex.ru")
-			d.checkMatchEmpty(t, "pornhub.com")
-			l := stats.Safebrowsing.Requests
-			d.checkMatchEmpty(t, "pornhub.com")
-			if stats.Safebrowsing.Requests != l {
-				t.Errorf("Safebrowsing lookup negative cache is not working: %v", stats.Safebrowsing.Requests)
-			}
-		})
+	if ret.IsFiltered || ret.Reason != FilteredParental || ret.BlockedResponse != nil {
+		t.Errorf("Expected parental match to be advisory, got %+v", ret)
 	}
+
+	ret, err = d.CheckHost("doubleclick.net")
+	if err != nil {
+		t.Fatalf("Error while matching host: %s", err)
+	}
+	if !ret.IsFiltered || ret.Reason != FilteredBlackList || ret.BlockedResponse == nil {
+		t.Errorf("Expected blacklist match to be enforced, got %+v", ret)
+	}
+
+	d.SetEnforcedReasons(0)
+	d.checkMatch(t, "pornhub.com")
 }
 
-func TestParallelSB(t *testing.T) {
+func TestHostWithSchemeAndPort(t *testing.T) {
 	d := NewForTest()
 	defer d.Destroy()
-	d.EnableSafeBrowsing()
-	t.Run("group", func(t *testing.T) {
-		for i := 0; i < 100; i++ {
-			t.Run(fmt.Sprintf("aaa%d", i), func(t *testing.T) {
-				t.Parallel()
-				d.checkMatch(t, "wmconvirus.narod.ru")
-				d.checkMatch(t, "wmconvirus.narod.ru.")
-				d.checkMatch(t, "test.wmconvirus.narod.ru")
-				d.checkMatch(t, "test.wmconvirus.narod.ru.")
-				d.checkMatchEmpty(t, "yandex.ru")
-				d.checkMatchEmpty(t, "pornhub.com")
-			})
+	d.checkAddRule(t, "||example.org^")
+
+	hosts := []string{"https://example.org", "example.org:443", "example.org.", "http://Example.org:8080"}
+	for _, host := range hosts {
+		d.checkMatch(t, host)
+	}
+	d.checkMatchEmpty(t, "https://example.com")
+
+	d.SetStrictHostValidation(true)
+	for _, host := range []string{"https://example.org", "example.org:443"} {
+		res, err := d.CheckHost(host)
+		if err != ErrInvalidHost || res.IsFiltered {
+			t.Errorf("expected %s to be rejected with ErrInvalidHost, got %+v, %v", host, res, err)
 		}
-	})
+	}
+	d.checkMatch(t, "example.org.")
 }
 
-// the only way to verify that custom server option is working is to point it at a server that does serve safebrowsing
-func TestSafeBrowsingCustomServerFail(t *testing.T) {
+func TestCoverage(t *testing.T) {
 	d := NewForTest()
 	defer d.Destroy()
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// w.Write("Hello, client")
-		fmt.Fprintln(w, "Hello, client")
-	}))
-	defer ts.Close()
-	address := ts.Listener.Addr().String()
+	d.checkAddRule(t, "||doubleclick.net^")
+	d.checkAddRule(t, "||ads.example.org^")
+	d.checkAddRule(t, "@@||good.ads.example.org^")
 
-	d.EnableSafeBrowsing()
-	d.SetHTTPTimeout(time.Second * 5)
-	d.SetSafeBrowsingServer(address) // this will ensure that test fails
-	d.checkMatchEmpty(t, "wmconvirus.narod.ru")
+	hosts := []string{
+		"doubleclick.net",
+		"ad.doubleclick.net",
+		"stats.doubleclick.net",
+		"ads.example.org",
+		"good.ads.example.org",
+		"example.org",
+		"google.com",
+		"bad host",
+	}
+	report := d.Coverage(hosts)
+	if report.Total != 8 || report.Blocked != 4 || report.Errors != 1 {
+		t.Fatalf("unexpected coverage %+v", report)
+	}
+	if report.Fraction() != 0.5 {
+		t.Errorf("expected half of hosts to be blocked, got %f", report.Fraction())
+	}
+	if len(report.ByReason) != 1 || report.ByReason[FilteredBlackList] != 4 {
+		t.Errorf("unexpected breakdown by reason %v", report.ByReason)
+	}
+	if len(report.TopRules) != 2 {
+		t.Fatalf("expected 2 top rules, got %+v", report.TopRules)
+	}
+	if report.TopRules[0].Text != "||doubleclick.net^" || report.TopRules[0].Hits != 3 {
+		t.Errorf("unexpected top rule %+v", report.TopRules[0])
+	}
+	if report.TopRules[1].Text != "||ads.example.org^" || report.TopRules[1].Hits != 1 {
+		t.Errorf("unexpected second rule %+v", report.TopRules[1])
+	}
 }
 
-func TestParentalControl(t *testing.T) {
-	d := NewForTest()
+func TestNewAllowlist(t *testing.T) {
+	d := NewAllowlist([]string{"example.org", "Wikipedia.org.", "bad host"})
 	defer d.Destroy()
-	d.EnableParental(3)
-	d.checkMatch(t, "pornhub.com")
-	d.checkMatch(t, "pornhub.com")
-	if stats.Parental.Requests != 1 {
-		t.Errorf("Parental lookup positive cache is not working")
-	}
-	d.checkMatch(t, "PORNhub.com")
-	if stats.Parental.Requests != 1 {
-		t.Errorf("Parental lookup positive cache is not working")
+
+	for _, host := range []string{"example.org", "www.example.org", "en.wikipedia.org"} {
+		ret, err := d.CheckHost(host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ret.IsFiltered || ret.Reason != NotFilteredWhiteList {
+			t.Errorf("Expected %s to be allowed, got %+v", host, ret)
+		}
 	}
-	d.checkMatch(t, "www.pornhub.com")
-	d.checkMatch(t, "pornhub.com.")
-	d.checkMatch(t, "www.pornhub.com.")
-	d.checkMatchEmpty(t, "www.yandex.ru")
-	d.checkMatchEmpty(t, "yandex.ru")
-	l := stats.Parental.Requests
-	d.checkMatchEmpty(t, "yandex.ru")
-	if stats.Parental.Requests != l {
-		t.Errorf("Parental lookup negative cache is not working")
+	for _, host := range []string{"google.com", "notexample.org", "example.org.evil.com"} {
+		ret, err := d.CheckHost(host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ret.IsFiltered || ret.Reason != FilteredBlackList {
+			t.Errorf("Expected %s to be blocked, got %+v", host, ret)
+		}
 	}
+}
 
-	d.checkMatchEmpty(t, "api.jquery.com")
+func TestRuleTrailingDot(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.checkAddRule(t, "||example.org.^")
+	d.checkAddRule(t, "@@||www.example.org.")
+	d.checkAddRule(t, "||example.com.|$important")
+	d.checkMatch(t, "example.org")
+	d.checkMatch(t, "ads.example.org.")
+	d.checkMatchEmpty(t, "www.example.org")
+	d.checkMatch(t, "example.com")
+	d.checkMatchEmpty(t, "example.com.net")
 }
 
-func TestSafeSearch(t *testing.T) {
+func TestRegexpRuleCase(t *testing.T) {
 	d := NewForTest()
 	defer d.Destroy()
-	_, ok := d.SafeSearchDomain("www.google.com")
-	if ok {
-		t.Errorf("Expected safesearch to error when disabled")
-	}
-	d.EnableSafeSearch()
-	val, ok := d.SafeSearchDomain("www.google.com")
-	if !ok {
-		t.Errorf("Expected safesearch to find result for www.google.com")
+	d.checkAddRule(t, "/Example\\.org/")
+	d.checkAddRule(t, "/^ADS[0-9]+\\.net/")
+	d.checkAddRule(t, "/^\\D+\\.digits\\.com/")
+	d.checkMatch(t, "example.org")
+	d.checkMatch(t, "WWW.EXAMPLE.ORG")
+	d.checkMatch(t, "ads1.net")
+	d.checkMatchEmpty(t, "ads.net")
+	d.checkMatch(t, "abc.digits.com")
+	d.checkMatchEmpty(t, "123.digits.com")
+}
+
+func TestBadfilterRemoval(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.checkAddRule(t, "||example.org^")
+	id, err := d.AddRuleID("||example.org^$badfilter", 2)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if val != "forcesafesearch.google.com" {
-		t.Errorf("Expected safesearch for google.com to be forcesafesearch.google.com")
+	d.checkMatchEmpty(t, "example.org")
+
+	c := d.Clone()
+	defer c.Destroy()
+	c.checkMatchEmpty(t, "example.org")
+
+	if !d.RemoveRuleByID(id) {
+		t.Fatalf("Couldn't remove $badfilter rule")
 	}
+	d.checkMatch(t, "example.org")
+	c.checkMatchEmpty(t, "example.org")
 }
 
 //
@@ -616,6 +4474,7 @@ func TestSafeSearch(t *testing.T) {
 var blockingRules = []string{"||example.org^"}
 var whitelistRules = []string{"||example.org^", "@@||test.example.org"}
 var importantRules = []string{"@@||example.org^", "||test.example.org^$important"}
+var importantWhitelistRules = []string{"||example.org^$important", "@@||test.example.org^$important", "||test.test.example.org^"}
 var regexRules = []string{"/example\\.org/", "@@||test.example.org^"}
 var maskRules = []string{"test*.example.org^", "exam*.com"}
 
@@ -645,6 +4504,10 @@ var tests = []struct {
 	{"important", importantRules, "test.test.example.org", true, FilteredBlackList},
 	{"important", importantRules, "testexample.org", false, NotFilteredNotFound},
 	{"important", importantRules, "onemoreexample.org", false, NotFilteredNotFound},
+	{"important-whitelist", importantWhitelistRules, "example.org", true, FilteredBlackList},
+	{"important-whitelist", importantWhitelistRules, "test.example.org", false, NotFilteredWhiteList},
+	{"important-whitelist", importantWhitelistRules, "test.test.example.org", false, NotFilteredWhiteList},
+	{"important-whitelist", importantWhitelistRules, "www.example.org", true, FilteredBlackList},
 	{"regex", regexRules, "example.org", true, FilteredBlackList},
 	{"regex", regexRules, "test.example.org", false, NotFilteredWhiteList},
 	{"regex", regexRules, "test.test.example.org", false, NotFilteredWhiteList},
@@ -685,6 +4548,87 @@ func TestMatching(t *testing.T) {
 	}
 }
 
+type listRule struct {
+	text   string
+	listID uint32
+}
+
+// precedenceTests document which rule decides the result when several rules from different filter lists match
+var precedenceTests = []struct {
+	testname string
+	rules    []listRule // added in this order
+	priority []uint32   // passed to SetFilterPriority
+	hostname string
+	reason   Reason
+	rule     string // text of the rule that decides the result as it was added, empty if no rule matches
+}{
+	{"block", []listRule{{"||example.org^", 1}}, nil, "ads.example.org", FilteredBlackList, "||example.org^"},
+	{"allow-same-list", []listRule{{"||example.org^", 1}, {"@@||ads.example.org^", 1}}, nil, "ads.example.org", NotFilteredWhiteList, "@@||ads.example.org^"},
+	{"allow-other-list", []listRule{{"||example.org^", 2}, {"@@||ads.example.org^", 1}}, nil, "ads.example.org", NotFilteredWhiteList, "@@||ads.example.org^"},
+	{"allow-added-first", []listRule{{"@@||ads.example.org^", 2}, {"||example.org^", 1}}, nil, "ads.example.org", NotFilteredWhiteList, "@@||ads.example.org^"},
+	{"important-over-allow", []listRule{{"@@||ads.example.org^", 1}, {"||example.org^$important", 2}}, nil, "ads.example.org", FilteredBlackList, "||example.org^$important"},
+	{"important-allow-over-important", []listRule{{"||example.org^$important", 2}, {"@@||ads.example.org^$important", 1}}, nil, "ads.example.org", NotFilteredWhiteList, "@@||ads.example.org^$important"},
+	{"important-allow-same-list", []listRule{{"||example.org^$important", 1}, {"@@||example.org^$important", 1}}, nil, "ads.example.org", NotFilteredWhiteList, "@@||example.org^$important"},
+
+	{"priority-block-first", []listRule{{"@@||ads.example.org^", 1}, {"||example.org^", 2}}, []uint32{2, 1}, "ads.example.org", FilteredBlackList, "||example.org^"},
+	{"priority-allow-first", []listRule{{"@@||ads.example.org^", 1}, {"||example.org^", 2}}, []uint32{1, 2}, "ads.example.org", NotFilteredWhiteList, "@@||ads.example.org^"},
+	{"priority-same-list", []listRule{{"||example.org^", 1}, {"@@||ads.example.org^", 1}}, []uint32{1}, "ads.example.org", NotFilteredWhiteList, "@@||ads.example.org^"},
+	{"priority-listed-first", []listRule{{"@@||ads.example.org^", 1}, {"||example.org^", 3}}, []uint32{3}, "ads.example.org", FilteredBlackList, "||example.org^"},
+	{"priority-unlisted-lower-id", []listRule{{"||example.org^", 2}, {"@@||ads.example.org^", 1}}, []uint32{3}, "ads.example.org", NotFilteredWhiteList, "@@||ads.example.org^"},
+	{"priority-added-first", []listRule{{"||example.org^", 1}, {"||ads.example.org^", 1}}, []uint32{1}, "ads.example.org", FilteredBlackList, "||example.org^"},
+	{"priority-higher-list", []listRule{{"||ads.example.org^", 2}, {"||example.org^", 1}}, []uint32{1, 2}, "ads.example.org", FilteredBlackList, "||example.org^"},
+	{"priority-important-block", []listRule{{"||example.org^$important", 1}, {"@@||ads.example.org^", 2}}, []uint32{2, 1}, "ads.example.org", FilteredBlackList, "||example.org^$important"},
+	{"priority-important-allow", []listRule{{"@@||example.org^$important", 1}, {"||ads.example.org^", 2}}, []uint32{2, 1}, "ads.example.org", NotFilteredWhiteList, "@@||example.org^$important"},
+
+	{"badfilter", []listRule{{"||example.org^", 1}, {"||example.org^$badfilter", 2}}, nil, "ads.example.org", NotFilteredNotFound, ""},
+	{"badfilter-added-first", []listRule{{"||example.org^$badfilter", 2}, {"||example.org^", 1}}, nil, "ads.example.org", NotFilteredNotFound, ""},
+	{"badfilter-allow", []listRule{{"||example.org^", 1}, {"@@||ads.example.org^", 1}, {"@@||ads.example.org^$badfilter", 2}}, nil, "ads.example.org", FilteredBlackList, "||example.org^"},
+	{"badfilter-other-options", []listRule{{"||example.org^$important", 1}, {"||example.org^$badfilter", 2}}, nil, "ads.example.org", FilteredBlackList, "||example.org^$important"},
+	{"badfilter-important", []listRule{{"||example.org^$important", 1}, {"@@||ads.example.org^", 1}, {"||example.org^$important,badfilter", 2}}, nil, "ads.example.org", NotFilteredWhiteList, "@@||ads.example.org^"},
+	{"badfilter-priority", []listRule{{"||example.org^", 1}, {"@@||ads.example.org^", 2}, {"@@||ads.example.org^$badfilter", 3}}, []uint32{2, 1}, "ads.example.org", FilteredBlackList, "||example.org^"},
+
+	{"denyallow", []listRule{{"||example.org^$denyallow=ads.example.org", 1}}, nil, "ads.example.org", NotFilteredNotFound, ""},
+	{"denyallow-other-host", []listRule{{"||example.org^$denyallow=ads.example.org", 1}}, nil, "www.example.org", FilteredBlackList, "||example.org^$denyallow=ads.example.org"},
+	{"denyallow-all", []listRule{{"*$denyallow=example.org|example.com", 1}}, nil, "ads.example.org", NotFilteredNotFound, ""},
+	{"denyallow-all-other-host", []listRule{{"*$denyallow=example.org|example.com", 1}}, nil, "example.net", FilteredBlackList, "*$denyallow=example.org|example.com"},
+	{"denyallow-allow", []listRule{{"||example.org^", 1}, {"@@||example.org^$denyallow=ads.example.org", 2}}, nil, "ads.example.org", FilteredBlackList, "||example.org^"},
+	{"denyallow-important", []listRule{{"||example.org^$important,denyallow=ads.example.org", 1}, {"||ads.example.org^", 2}, {"@@||www.example.org^", 2}}, nil, "ads.example.org", FilteredBlackList, "||ads.example.org^"},
+	{"denyallow-important-other-host", []listRule{{"||example.org^$important,denyallow=ads.example.org", 1}, {"||ads.example.org^", 2}, {"@@||www.example.org^", 2}}, nil, "www.example.org", FilteredBlackList, "||example.org^$important,denyallow=ads.example.org"},
+}
+
+func TestPrecedence(t *testing.T) {
+	for _, test := range precedenceTests {
+		t.Run(fmt.Sprintf("%s-%s", test.testname, test.hostname), func(t *testing.T) {
+			d := NewForTest()
+			defer d.Destroy()
+			for _, r := range test.rules {
+				err := d.AddRule(r.text, r.listID)
+				if err != nil {
+					t.Fatalf("Couldn't add rule %s: %s", r.text, err)
+				}
+			}
+			d.SetFilterPriority(test.priority)
+			ret, err := d.CheckHost(test.hostname)
+			if err != nil {
+				t.Fatalf("Error while matching host %s: %s", test.hostname, err)
+			}
+			if ret.Reason != test.reason {
+				t.Errorf("Hostname %s has wrong reason (%v must be %v)", test.hostname, ret.Reason, test.reason)
+			}
+			if test.rule == "" {
+				if ret.RuleID != 0 {
+					t.Errorf("Hostname %s must not be matched, got rule %s", test.hostname, ret.Rule)
+				}
+				return
+			}
+			info, ok := d.GetRule(test.rule)
+			if !ok || ret.RuleID != info.ID || ret.FilterID != info.FilterListID {
+				t.Errorf("Hostname %s must be decided by %s, got rule %s from list %d", test.hostname, test.rule, ret.Rule, ret.FilterID)
+			}
+		})
+	}
+}
+
 //
 // benchmarks
 //
@@ -808,6 +4752,45 @@ func BenchmarkLotsOfRulesMatchParallel(b *testing.B) {
 	})
 }
 
+// BenchmarkCheckHostStream replays queries from the file in DNSFILTER_QUERY_TRACE, see CheckHostStream
+// without it, a synthetic stream where few popular hosts are queried most of the time is used
+func BenchmarkCheckHostStream(b *testing.B) {
+	d := NewForTest()
+	defer d.Destroy()
+	mustLoadTestRules(d)
+
+	hosts := []string{}
+	if filename := os.Getenv("DNSFILTER_QUERY_TRACE"); filename != "" {
+		file, err := os.Open(filename)
+		if err != nil {
+			b.Fatal(err)
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			hosts = append(hosts, scanner.Text())
+		}
+		file.Close()
+		if err = scanner.Err(); err != nil {
+			b.Fatal(err)
+		}
+	} else {
+		for i := 0; i < 1000; i++ {
+			switch {
+			case i%10 < 6:
+				hosts = append(hosts, fmt.Sprintf("www.popular%d.com", i%3))
+			case i%10 < 8:
+				hosts = append(hosts, fmt.Sprintf("ad%d.doubleclick.net", i))
+			default:
+				hosts = append(hosts, fmt.Sprintf("host%d.example%d.org", i, i%50))
+			}
+		}
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		d.CheckHostStream(hosts)
+	}
+}
+
 func BenchmarkLotsOfRulesLotsOfHosts(b *testing.B) {
 	d := NewForTest()
 	defer d.Destroy()
@@ -956,12 +4939,9 @@ func TestMain(m *testing.M) {
 // helper functions for debugging and testing
 //
 func purgeCaches() {
-	if safebrowsingCache != nil {
-		safebrowsingCache.Purge()
-	}
-	if parentalCache != nil {
-		parentalCache.Purge()
-	}
+	safebrowsing, parental := lookupCaches()
+	safebrowsing.Purge()
+	parental.Purge()
 }
 
 func _Func() string {
@@ -0,0 +1,59 @@
+package dnsfilter
+
+import (
+	"errors"
+	"expvar"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrExpvarExists is returned by PublishExpvar when a variable with the same name is already published
+var ErrExpvarExists = errors.New("dnsfilter: expvar with this name is already published")
+
+// numReasons is the number of Reason values, for counting checks by reason
+const numReasons = int(FilteredSafeSearch) + 1
+
+// countReason counts check decided with reason
+func (d *Dnsfilter) countReason(reason Reason) {
+	if reason >= 0 && int(reason) < numReasons {
+		atomic.AddUint64(&d.reasonCounts[reason], 1)
+	}
+}
+
+// PublishExpvar publishes counters of this Dnsfilter with expvar under name, so that they can be seen at /debug/vars
+// they include number of rules, checks by reason as in the match hook, and safebrowsing and parental lookup stats, which are shared by all instances
+// expvar can't unpublish variables, so the name should be unique for the process and Dnsfilter is never garbage collected after the call
+func (d *Dnsfilter) PublishExpvar(name string) error {
+	publishMutex.Lock()
+	defer publishMutex.Unlock()
+	if expvar.Get(name) != nil {
+		return ErrExpvarExists
+	}
+	expvar.Publish(name, expvar.Func(d.expvarValue))
+	return nil
+}
+
+// publishMutex makes checking and publishing expvar name atomic, otherwise concurrent PublishExpvar calls with the same name could panic
+var publishMutex sync.Mutex
+
+// expvarValue returns counters published by PublishExpvar
+func (d *Dnsfilter) expvarValue() interface{} {
+	d.storageMutex.RLock()
+	rules := len(d.rulesByID)
+	d.storageMutex.RUnlock()
+
+	checks := make(map[string]uint64, numReasons)
+	for i := 0; i < numReasons; i++ {
+		checks[Reason(i).String()] = atomic.LoadUint64(&d.reasonCounts[i])
+	}
+	stats := d.StatsSnapshot()
+	return map[string]interface{}{
+		"rules":           rules,
+		"whitelist_rules": d.WhitelistCount(),
+		"blacklist_rules": d.BlacklistCount(),
+		"checks":          checks,
+		"would_block":     d.WouldBlock(),
+		"safebrowsing":    stats.Safebrowsing,
+		"parental":        stats.Parental,
+	}
+}
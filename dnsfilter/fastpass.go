@@ -0,0 +1,44 @@
+package dnsfilter
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// LoadFastPassDomains replaces the set of known clean hostnames with the ones read from r
+// checks of these hostnames return NotFilteredNotFound right away, without matching rules or doing safebrowsing and parental lookups
+// r has one hostname per line, lines in `rank,hostname` format of top sites lists and # comments are accepted too
+// only exact hostnames are skipped, not their subdomains
+func (d *Dnsfilter) LoadFastPassDomains(r io.Reader) error {
+	domains := map[string]bool{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if i := strings.LastIndexByte(line, ','); i >= 0 {
+			line = line[i+1:]
+		}
+		host := normalizeHost(line)
+		if host != "" {
+			domains[host] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	d.fastPassMutex.Lock()
+	d.fastPass = domains
+	d.fastPassMutex.Unlock()
+	return nil
+}
+
+// isFastPass tells if normalized host is in the set loaded by LoadFastPassDomains
+func (d *Dnsfilter) isFastPass(host string) bool {
+	d.fastPassMutex.RLock()
+	defer d.fastPassMutex.RUnlock()
+	return d.fastPass[host]
+}
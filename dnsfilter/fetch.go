@@ -0,0 +1,96 @@
+package dnsfilter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// FilterFetchError is returned by LoadFilterURL when server responds with a status other than 200 OK
+type FilterFetchError struct {
+	URL        string
+	StatusCode int
+}
+
+func (e *FilterFetchError) Error() string {
+	return fmt.Sprintf("dnsfilter: couldn't fetch filter list %s: %d %s", e.URL, e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// SetFilterFetchRetry lets you optionally make LoadFilterURL retry failed downloads
+// list is fetched up to attempts times, waiting backoff before the first retry and twice as long before each next one
+// only network errors and 5xx responses are retried, default is a single attempt
+func (d *Dnsfilter) SetFilterFetchRetry(attempts int, backoff time.Duration) {
+	if attempts < 1 {
+		attempts = 1
+	}
+	d.config.fetchAttempts = attempts
+	d.config.fetchBackoff = backoff
+}
+
+// LoadFilterURL downloads filter list from url and adds its rules like LoadRules does
+// ctx bounds the whole download including retries, see SetFilterFetchRetry
+// rules are added only after the list is downloaded completely, so a failed download doesn't leave a part of the list loaded
+// Duration of the result doesn't include the download
+func (d *Dnsfilter) LoadFilterURL(ctx context.Context, url string, filterListID uint32) (LoadResult, error) {
+	body, err := d.fetchFilter(ctx, url)
+	if err != nil {
+		return LoadResult{}, err
+	}
+	return d.LoadRules(bytes.NewReader(body), filterListID)
+}
+
+// fetchFilter downloads filter list, retrying transient errors
+func (d *Dnsfilter) fetchFilter(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", d.config.userAgent)
+
+	backoff := d.config.fetchBackoff
+	for attempt := 1; ; attempt++ {
+		body, err := d.fetchFilterOnce(req)
+		if err == nil || attempt >= d.config.fetchAttempts || !isTransientFetchError(err) || ctx.Err() != nil {
+			return body, err
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+func (d *Dnsfilter) fetchFilterOnce(req *http.Request) ([]byte, error) {
+	// lists can be large, so lookup timeout doesn't apply here, request context does
+	client := d.customClient
+	if client == nil {
+		client = &http.Client{Transport: d.transport}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &FilterFetchError{URL: req.URL.String(), StatusCode: resp.StatusCode}
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// isTransientFetchError tells if download may succeed if it's tried again, which is the case for network errors and server errors
+func isTransientFetchError(err error) bool {
+	if fetchErr, ok := err.(*FilterFetchError); ok {
+		return fetchErr.StatusCode >= 500
+	}
+	return true
+}
@@ -3,9 +3,16 @@ package dnsfilter
 import (
 	"strings"
 	"sync/atomic"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
 )
 
 func isValidRule(rule string) bool {
+	// rules that match all hosts are too short to pass the length check
+	if rule == "*" || rule == "@@*" || strings.HasPrefix(rule, "*$") || strings.HasPrefix(rule, "@@*$") {
+		return true
+	}
 	if len(rule) < 4 {
 		return false
 	}
@@ -38,6 +45,203 @@ func isValidRule(rule string) bool {
 	return true
 }
 
+// normalizeHost lowercases host and strips surrounding whitespace and the trailing dot of fully qualified names
+// leading scheme and trailing port, e.g. of http://example.org:8080, are stripped too
+func normalizeHost(host string) string {
+	host, _ = stripSchemeAndPort(strings.TrimSpace(host))
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// stripSchemeAndPort removes `scheme://` prefix and `:port` suffix from host, and tells if there was any
+// hosts with more than one colon are IPv6 addresses and are returned as is
+func stripSchemeAndPort(host string) (string, bool) {
+	stripped := false
+	if i := strings.Index(host, "://"); i >= 0 {
+		host = host[i+len("://"):]
+		stripped = true
+	}
+	if i := strings.IndexByte(host, ':'); i >= 0 && i == strings.LastIndexByte(host, ':') && isPort(host[i+1:]) {
+		host = host[:i]
+		stripped = true
+	}
+	return host, stripped
+}
+
+// isPort tells if s is a decimal port number
+func isPort(s string) bool {
+	if s == "" || len(s) > 5 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// isValidHost tells if normalized host consists of non-empty labels of letters, digits, hyphens and underscores
+// non-ASCII characters are allowed for internationalized names that were not converted to punycode
+func isValidHost(host string) bool {
+	for _, label := range strings.Split(host, ".") {
+		if label == "" {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			switch {
+			case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '_', c >= 0x80:
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isStrictHost tells if normalized host conforms to RFC 1035, see SetStrictHostValidation
+func isStrictHost(host string) bool {
+	if len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return false
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			switch {
+			case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-':
+			case c == '_' && i == 0:
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// trimRuleTrailingDot removes trailing dot of the domain in rule text, like normalizeHost does for hosts, e.g. ||example.org.^ becomes ||example.org^
+func trimRuleTrailingDot(text string) string {
+	end := len(text)
+	if end > 0 && (text[end-1] == '^' || text[end-1] == '|') {
+		end--
+	}
+	if end < 2 || text[end-1] != '.' || text[end-2] == '.' || text[end-2] == '|' {
+		return text
+	}
+	return text[:end-1] + text[end:]
+}
+
+// punycodeRule converts Unicode labels of rule text to punycode
+// if a Unicode label is next to a wildcard, it's only a part of the real label, then text is returned as is
+func punycodeRule(text string) string {
+	const separators = ".|^*/:"
+	b := strings.Builder{}
+	for start := 0; start < len(text); {
+		end := strings.IndexAny(text[start:], separators)
+		if end < 0 {
+			end = len(text)
+		} else {
+			end += start
+		}
+		label := text[start:end]
+		if !isASCII(label) {
+			if (start > 0 && text[start-1] == '*') || (end < len(text) && text[end] == '*') {
+				return text
+			}
+			if converted, err := idna.ToASCII(label); err == nil {
+				label = converted
+			}
+		}
+		b.WriteString(label)
+		if end < len(text) {
+			b.WriteByte(text[end])
+		}
+		start = end + 1
+	}
+	return b.String()
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// isKeyword tells if rule text is a single label without anchors and wildcards, like doubleclick
+func isKeyword(text string) bool {
+	if text == "" {
+		return false
+	}
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// hasLabel tells if label is one of the labels of host
+func hasLabel(host string, label string) bool {
+	for {
+		i := strings.Index(host, label)
+		if i < 0 {
+			return false
+		}
+		end := i + len(label)
+		if (i == 0 || host[i-1] == '.') && (end == len(host) || host[end] == '.') {
+			return true
+		}
+		host = host[i+1:]
+	}
+}
+
+// hasNameBeforePublicSuffix tells if host is name followed by a public suffix, or a subdomain of such host
+// e.g. ads.co.uk and www.ads.com for name ads, but not ads.example.com
+func hasNameBeforePublicSuffix(host string, name string) bool {
+	suffix, _ := publicsuffix.PublicSuffix(host)
+	if len(host) <= len(suffix)+1 {
+		// host is the public suffix itself
+		return false
+	}
+	rest := host[:len(host)-len(suffix)-1]
+	return rest == name || strings.HasSuffix(rest, "."+name)
+}
+
+// blockedTLD returns public suffix of host, or a shorter suffix of it, that is in tlds, e.g. uk for ads.co.uk
+// host that is a public suffix itself is never under a blocked TLD
+func blockedTLD(host string, tlds map[string]bool) (string, bool) {
+	suffix, _ := publicsuffix.PublicSuffix(host)
+	if len(host) <= len(suffix)+1 {
+		return "", false
+	}
+	for {
+		if tlds[suffix] {
+			return suffix, true
+		}
+		i := strings.IndexByte(suffix, '.')
+		if i < 0 {
+			return "", false
+		}
+		suffix = suffix[i+1:]
+	}
+}
+
+// isSubdomain tells if host is domain itself or its subdomain
+func isSubdomain(host string, domain string) bool {
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
 func updateMax(valuePtr *int64, maxPtr *int64) {
 	for {
 		current := atomic.LoadInt64(valuePtr)
@@ -0,0 +1,455 @@
+package dnsfilter
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// filterIDMarker is a comment line that switches filter list ID for the rules following it
+const filterIDMarker = "! Filter ID:"
+
+// parseFilterIDMarker checks if line is a `! Filter ID: N` marker and returns N
+func parseFilterIDMarker(line string) (uint32, bool) {
+	if !strings.HasPrefix(line, filterIDMarker) {
+		return 0, false
+	}
+	value := strings.TrimSpace(strings.TrimPrefix(line, filterIDMarker))
+	id, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(id), true
+}
+
+// IsRuleError tells if AddRule failed because of the rule itself, so that loading of other rules can continue
+func IsRuleError(err error) bool {
+	switch err {
+	case ErrInvalidSyntax, ErrInvalidDNSRewrite, ErrInvalidLabels, ErrRegexRulesDisabled, ErrUnknownModifier:
+		return true
+	}
+	return false
+}
+
+// RuleDecoder reads rules from a filter list in some format, see RegisterRuleDecoder
+type RuleDecoder interface {
+	// Sniff tells if list starting with header is in decoder's format, header is shorter than sniffLen only for short lists
+	Sniff(header []byte) bool
+	// Decode calls fn for each rule or comment line in r, and stops if fn returns an error
+	Decode(r io.Reader, fn func(line string) error) error
+}
+
+const sniffLen = 512 // number of bytes passed to RuleDecoder.Sniff
+
+var (
+	ruleDecoders      []RuleDecoder // registered decoders, text decoder is used if none of them recognizes the list
+	ruleDecodersMutex sync.RWMutex
+)
+
+// RegisterRuleDecoder adds decoder for a custom filter list format to LoadRulesFromReader
+// decoders are tried in the order they were registered, plain text format is used if none of them recognizes the list
+func RegisterRuleDecoder(decoder RuleDecoder) {
+	ruleDecodersMutex.Lock()
+	ruleDecoders = append(ruleDecoders, decoder)
+	ruleDecodersMutex.Unlock()
+}
+
+// findRuleDecoder returns decoder for the list starting with header
+func findRuleDecoder(header []byte) RuleDecoder {
+	ruleDecodersMutex.RLock()
+	defer ruleDecodersMutex.RUnlock()
+	for _, decoder := range ruleDecoders {
+		if decoder.Sniff(header) {
+			return decoder
+		}
+	}
+	return textDecoder{}
+}
+
+// textDecoder reads filter lists with one rule per line, which is the default format
+type textDecoder struct{}
+
+func (textDecoder) Sniff(header []byte) bool {
+	return true
+}
+
+func (textDecoder) Decode(r io.Reader, fn func(line string) error) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		err := fn(scanner.Text())
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// LoadResult describes the outcome of LoadRules
+type LoadResult struct {
+	Added   int         // number of rules that were added
+	Skipped int         // number of valid rules that can't be used for DNS filtering, e.g. cosmetic ones like example.org##.banner
+	Errors  []LineError // rules that couldn't be added because they are invalid, e.g. have broken regexps or unknown modifiers
+
+	Duration       time.Duration // time it took to read the list and add its rules
+	RulesPerSecond float64       // Added divided by Duration, very low value means the list is slow to load, e.g. because of lots of regexps
+}
+
+// LineError describes an invalid rule that LoadRules couldn't add
+type LineError struct {
+	Line int    // line number in the list, starting from 1
+	Text string // rule as it was in the list
+	Err  error
+}
+
+func (e LineError) Error() string {
+	return fmt.Sprintf("line %d: %s: %v", e.Line, e.Text, e.Err)
+}
+
+// Unwrap returns the reason rule is invalid, e.g. ErrUnknownModifier
+func (e LineError) Unwrap() error {
+	return e.Err
+}
+
+// hostsLocalNames are names that hosts files map to loopback addresses for the system itself, they are never turned into rules
+var hostsLocalNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+	"0.0.0.0":               true,
+}
+
+// hostsLineRules converts hosts-format line like `0.0.0.0 ads.com tracker.com # comment` to rules for each of its hostnames
+// unspecified and loopback addresses block the hosts, other addresses are answered with $dnsrewrite
+// returns false if line isn't an IP address followed by hostnames and so is not in hosts format
+func hostsLineRules(line string) ([]string, bool) {
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return nil, false
+	}
+	ip := net.ParseIP(fields[0])
+	if ip == nil {
+		return nil, false
+	}
+	rules := []string{}
+	for _, host := range fields[1:] {
+		host = strings.ToLower(host)
+		if hostsLocalNames[host] {
+			continue
+		}
+		if ip.IsUnspecified() || ip.IsLoopback() {
+			rules = append(rules, "||"+host+"^")
+		} else {
+			rules = append(rules, "||"+host+"^$dnsrewrite="+ip.String())
+		}
+	}
+	return rules, true
+}
+
+const utf8BOM = "\ufeff" // some editors put it at the beginning of the list
+
+// stripControlChars removes NULs and other control characters that sometimes end up in downloaded lists, tabs are kept
+func stripControlChars(line string) string {
+	for i := 0; i < len(line); i++ {
+		if c := line[i]; (c < 0x20 && c != '\t') || c == 0x7f {
+			return strings.Map(func(r rune) rune {
+				if (r < 0x20 && r != '\t') || r == 0x7f {
+					return -1
+				}
+				return r
+			}, line)
+		}
+	}
+	return line
+}
+
+// LoadRulesFromReader adds rules from r line by line, skipping comments, rules with invalid syntax and disabled rules
+// rules are assigned filterListID until a `! Filter ID: N` marker is met, after which they are assigned N
+// format of the list is detected by its first bytes, see RegisterRuleDecoder
+// returns number of rules that were added
+func (d *Dnsfilter) LoadRulesFromReader(r io.Reader, filterListID uint32) (int, error) {
+	result, err := d.LoadRules(r, filterListID)
+	return result.Added, err
+}
+
+// LoadRules is like LoadRulesFromReader, but also reports invalid rules along with their line numbers and counts skipped ones
+// invalid rules are skipped as well, so that one bad rule doesn't prevent the rest of the list from loading
+// leading UTF-8 BOM and control characters in lines are ignored
+// lines starting with an IP address are read as hosts file entries, so lists mixing both formats can be loaded as is, see hostsLineRules
+func (d *Dnsfilter) LoadRules(r io.Reader, filterListID uint32) (LoadResult, error) {
+	start := time.Now()
+	br := bufio.NewReaderSize(r, sniffLen)
+	// errors are reported by decoder when it reads the list
+	if bom, _ := br.Peek(len(utf8BOM)); string(bom) == utf8BOM {
+		br.Discard(len(utf8BOM))
+	}
+	header, _ := br.Peek(sniffLen)
+	decoder := findRuleDecoder(header)
+
+	result := LoadResult{}
+	lineNumber := 0
+	metas := map[uint32]*FilterMeta{filterListID: {}}
+	err := decoder.Decode(br, func(line string) error {
+		lineNumber++
+		line = strings.TrimSpace(stripControlChars(line))
+		if id, ok := parseFilterIDMarker(line); ok {
+			filterListID = id
+			if metas[id] == nil {
+				metas[id] = &FilterMeta{}
+			}
+			return nil
+		}
+		parseFilterMetaHeader(line, metas[filterListID])
+		rules, ok := hostsLineRules(line)
+		if !ok {
+			rules = []string{line}
+		}
+		for _, text := range rules {
+			_, err := d.addRuleLine(text, filterListID, "", lineNumber)
+			if regexpErr, ok := err.(*invalidRegexpError); ok {
+				result.Errors = append(result.Errors, LineError{Line: lineNumber, Text: line, Err: regexpErr.err})
+				d.logSkipped(lineNumber, line, regexpErr)
+				continue
+			}
+			if skipped, ok := err.(*skippedRuleError); ok {
+				result.Skipped++
+				d.logSkipped(lineNumber, line, skipped)
+				continue
+			}
+			if IsRuleError(err) && !isCommentLine(line) {
+				if isCosmeticRule(line) {
+					result.Skipped++
+				} else {
+					result.Errors = append(result.Errors, LineError{Line: lineNumber, Text: line, Err: err})
+				}
+			}
+			if err == errRuleExists || IsRuleError(err) {
+				d.logSkipped(lineNumber, line, err)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			result.Added++
+		}
+		return nil
+	})
+	if err == nil {
+		now := time.Now()
+		for id, meta := range metas {
+			meta.LoadedAt = now
+			d.setFilterMeta(id, *meta)
+		}
+	}
+	result.Duration = time.Since(start)
+	if result.Duration > 0 {
+		result.RulesPerSecond = float64(result.Added) / result.Duration.Seconds()
+	}
+	return result, err
+}
+
+const addRulesProgressInterval = 10000 // number of rules between AddRulesFunc progress calls
+
+// AddRulesFunc adds rules received from rules channel until it's closed, skipping comments and invalid rules like LoadRules does
+// progress, if not nil, is called with the number of rules received so far after every 10000 rules and after the last one, e.g. to show a loading bar
+// rules are added one by one, so checks done during the load see a partially loaded list
+// returns number of rules that were added, rules channel is drained even if an error occurs
+func (d *Dnsfilter) AddRulesFunc(rules <-chan string, filterListID uint32, progress func(done int)) (int, error) {
+	added, done := 0, 0
+	var firstErr error
+	for text := range rules {
+		done++
+		if firstErr == nil {
+			_, err := d.addRule(stripControlChars(text), filterListID, "")
+			if _, ok := err.(*invalidRegexpError); ok || err == errRuleExists || IsRuleError(err) {
+				err = nil
+			} else if err == nil {
+				added++
+			}
+			firstErr = err
+		}
+		if progress != nil && done%addRulesProgressInterval == 0 {
+			progress(done)
+		}
+	}
+	if progress != nil && done%addRulesProgressInterval != 0 {
+		progress(done)
+	}
+	return added, firstErr
+}
+
+// logSkipped reports line that LoadRules didn't add to the function set by SetSkipLog, unless it's a comment
+func (d *Dnsfilter) logSkipped(lineNo int, line string, err error) {
+	if d.skipLog == nil || isCommentLine(line) {
+		return
+	}
+	d.skipLog(lineNo, line, strings.TrimPrefix(err.Error(), "dnsfilter: "))
+}
+
+// cosmeticMarkers start generic cosmetic rules like ##.banner, which are not comments even though they start with #
+var cosmeticMarkers = []string{"##", "#@#", "#$#", "#@$#", "#%#", "#@%#", "#?#"}
+
+// htmlFilterMarkers start HTML filtering rules, which are cosmetic too
+var htmlFilterMarkers = []string{"$$", "$@$"}
+
+// isCosmeticRule tells if line is a cosmetic or HTML filtering rule, which only browsers can apply
+func isCosmeticRule(line string) bool {
+	for _, markers := range [][]string{cosmeticMarkers, htmlFilterMarkers} {
+		for _, marker := range markers {
+			if strings.Contains(line, marker) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isCommentLine tells if line of a list is empty, a comment or a header
+func isCommentLine(line string) bool {
+	if line == "" || line[0] == '!' || strings.HasPrefix(line, "[Adblock") {
+		return true
+	}
+	if line[0] != '#' {
+		return false
+	}
+	for _, marker := range cosmeticMarkers {
+		if strings.HasPrefix(line, marker) {
+			return false
+		}
+	}
+	return true
+}
+
+// ExportRules writes all added rules to w, grouped by filter list ID
+// groups are sorted by filter list ID and rules within them by text, so that exports of the same rules are identical
+// each group is preceded by a `! Filter ID: N` marker so that LoadRulesFromReader can restore the IDs
+func (d *Dnsfilter) ExportRules(w io.Writer) error {
+	d.storageMutex.RLock()
+	byFilter := map[uint32][]string{}
+	for _, rule := range d.storage {
+		byFilter[rule.listID] = append(byFilter[rule.listID], rule.originalText)
+	}
+	d.storageMutex.RUnlock()
+
+	ids := make([]uint32, 0, len(byFilter))
+	for id := range byFilter {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	bw := bufio.NewWriter(w)
+	for _, id := range ids {
+		fmt.Fprintf(bw, "%s %d\n", filterIDMarker, id)
+		texts := byFilter[id]
+		sort.Strings(texts)
+		for _, text := range texts {
+			bw.WriteString(text)
+			bw.WriteByte('\n')
+		}
+	}
+	return bw.Flush()
+}
+
+// RuleSetHash returns hex-encoded SHA-256 of all added rules with their filter list IDs and enabled state, sorted by text, so it doesn't depend on the order rules were added in
+// it can be compared before and after a list refresh to tell if the rules actually changed
+func (d *Dnsfilter) RuleSetHash() string {
+	d.storageMutex.RLock()
+	lines := make([]string, 0, len(d.storage))
+	for text, rule := range d.storage {
+		lines = append(lines, fmt.Sprintf("%s\t%d\t%t\n", text, rule.listID, !rule.isDisabled()))
+	}
+	d.storageMutex.RUnlock()
+	sort.Strings(lines)
+
+	h := sha256.New()
+	for _, line := range lines {
+		h.Write([]byte(line))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// CountByFilter returns number of rules added with specified filter list ID
+func (d *Dnsfilter) CountByFilter(filterListID uint32) int {
+	d.storageMutex.RLock()
+	defer d.storageMutex.RUnlock()
+	return d.filterCounts[filterListID]
+}
+
+// FilterIDs returns sorted IDs of filter lists that have at least one added rule
+func (d *Dnsfilter) FilterIDs() []uint32 {
+	d.storageMutex.RLock()
+	ids := make([]uint32, 0, len(d.filterCounts))
+	for id := range d.filterCounts {
+		ids = append(ids, id)
+	}
+	d.storageMutex.RUnlock()
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// DiffReplaceRules makes rules of the filter list to be exactly newRules, adding and removing only the rules that differ
+// unchanged rules keep their IDs and hit counters, comments, invalid rules and rules already added by other lists are skipped
+// returns number of rules that were added and removed
+func (d *Dnsfilter) DiffReplaceRules(filterListID uint32, newRules []string) (added, removed int, err error) {
+	wanted := make(map[string]bool, len(newRules))
+	for _, text := range newRules {
+		wanted[strings.TrimSpace(text)] = true
+	}
+
+	stale := []uint64{}
+	d.storageMutex.RLock()
+	for text, rule := range d.storage {
+		if rule.listID != filterListID {
+			continue
+		}
+		if wanted[text] {
+			// already there
+			delete(wanted, text)
+		} else {
+			stale = append(stale, rule.id)
+		}
+	}
+	d.storageMutex.RUnlock()
+
+	for _, id := range stale {
+		if d.RemoveRuleByID(id) {
+			removed++
+		}
+	}
+	// rules are added in the order of newRules, so that their IDs and precedence don't change from run to run
+	for _, text := range newRules {
+		text = strings.TrimSpace(text)
+		if !wanted[text] {
+			// already there or a duplicate
+			continue
+		}
+		delete(wanted, text)
+		_, err = d.addRule(text, filterListID, "")
+		if _, ok := err.(*invalidRegexpError); ok || err == errRuleExists || IsRuleError(err) {
+			continue
+		}
+		if err != nil {
+			return added, removed, err
+		}
+		added++
+	}
+	return added, removed, nil
+}
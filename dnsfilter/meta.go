@@ -0,0 +1,76 @@
+package dnsfilter
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FilterMeta holds metadata of a filter list that was loaded by LoadRules
+type FilterMeta struct {
+	Title    string        // from `! Title:` header
+	Expires  time.Duration // from `! Expires:` header, zero if there is none
+	LoadedAt time.Time     // when the list was loaded last time
+}
+
+// filterMetaHeaders are comment lines that set fields of FilterMeta
+const (
+	titleHeader   = "! Title:"
+	expiresHeader = "! Expires:"
+)
+
+// parseFilterMetaHeader updates meta if line is one of the metadata headers
+func parseFilterMetaHeader(line string, meta *FilterMeta) {
+	switch {
+	case strings.HasPrefix(line, titleHeader):
+		meta.Title = strings.TrimSpace(strings.TrimPrefix(line, titleHeader))
+	case strings.HasPrefix(line, expiresHeader):
+		expires, ok := parseExpires(strings.TrimPrefix(line, expiresHeader))
+		if ok {
+			meta.Expires = expires
+		}
+	}
+}
+
+// parseExpires parses value of `! Expires:` header, e.g. `4 days (update frequency)` or `12 hours`
+// number without unit is in days
+func parseExpires(value string) (time.Duration, bool) {
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return 0, false
+	}
+	n, err := strconv.Atoi(fields[0])
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+	unit := 24 * time.Hour
+	if len(fields) > 1 && strings.HasPrefix(fields[1], "hour") {
+		unit = time.Hour
+	}
+	return time.Duration(n) * unit, true
+}
+
+// setFilterMeta stores metadata of the filter list that was just loaded
+func (d *Dnsfilter) setFilterMeta(filterListID uint32, meta FilterMeta) {
+	d.filterMetaMutex.Lock()
+	d.filterMeta[filterListID] = meta
+	d.filterMetaMutex.Unlock()
+}
+
+// FilterMeta returns metadata of the filter list, false if no list with such ID was loaded by LoadRules
+func (d *Dnsfilter) FilterMeta(filterListID uint32) (FilterMeta, bool) {
+	d.filterMetaMutex.Lock()
+	defer d.filterMetaMutex.Unlock()
+	meta, ok := d.filterMeta[filterListID]
+	return meta, ok
+}
+
+// NextRefreshTime returns when the filter list should be loaded again according to its `! Expires:` header
+// returns false if list wasn't loaded or has no such header
+func (d *Dnsfilter) NextRefreshTime(filterListID uint32) (time.Time, bool) {
+	meta, ok := d.FilterMeta(filterListID)
+	if !ok || meta.Expires == 0 {
+		return time.Time{}, false
+	}
+	return meta.LoadedAt.Add(meta.Expires), true
+}
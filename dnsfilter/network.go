@@ -0,0 +1,51 @@
+package dnsfilter
+
+import (
+	"net"
+	"strings"
+)
+
+// extractNetwork handles rules like ||192.168.0.0/16^ that are matched against resolved IP addresses by CheckIP
+// rules like *$network=192.168.0.0/16 already have network set by parseOptions
+func (rule *rule) extractNetwork() {
+	if rule.network != nil || !strings.HasPrefix(rule.text, "||") {
+		return
+	}
+	text := strings.TrimRight(rule.text[2:], "^|")
+	if !strings.Contains(text, "/") {
+		return
+	}
+	_, network, err := net.ParseCIDR(text)
+	if err != nil {
+		return
+	}
+	rule.network = network
+}
+
+func (r *rulesTable) matchByIP(ip net.IP) Result {
+	r.RLock()
+	defer r.RUnlock()
+	for _, rule := range r.rulesByNetwork {
+		if rule.isDisabled() {
+			continue
+		}
+		if rule.network.Contains(ip) {
+			return rule.matchedResult()
+		}
+	}
+	return Result{}
+}
+
+// CheckIP tries to match IP address from DNS response against rules with network targets, like ||192.168.0.0/16^ or *$network=192.168.0.0/16
+func (d *Dnsfilter) CheckIP(ip net.IP) (Result, error) {
+	if ip == nil || d.isFilteringDisabled() {
+		return Result{}, nil
+	}
+	for _, table := range d.tables() {
+		res := table.matchByIP(ip)
+		if res.Reason.Matched() {
+			return res, nil
+		}
+	}
+	return Result{}, nil
+}
@@ -0,0 +1,75 @@
+package dnsfilter
+
+import (
+	"net"
+	"sync/atomic"
+
+	"github.com/bluele/gcache"
+)
+
+// resultCacheKey identifies queries that are decided by the same rules
+type resultCacheKey struct {
+	host     string
+	qclass   uint16
+	protocol string
+}
+
+// resultCacheEntry is a result of matching rules, valid while rules generation is the same
+type resultCacheEntry struct {
+	generation uint64
+	result     Result
+}
+
+// SetResultCache lets you optionally cache results of matching rules for size most recently checked hosts, e.g. for very hot repeated queries
+// only rule matches are cached, safebrowsing and parental have caches of their own, queries with client addresses are never cached
+// cached results are invalidated when rules are added, removed, enabled or disabled, zero or negative size turns the cache off, which is the default
+func (d *Dnsfilter) SetResultCache(size int) {
+	if size < 0 {
+		size = 0
+	}
+	d.config.resultCacheSize = size
+	d.resultCache = nil
+	if size > 0 {
+		d.resultCache = gcache.New(size).LRU().Build()
+	}
+}
+
+// invalidateResults makes results cached before the call stale, it's called on each change of rules
+func (d *Dnsfilter) invalidateResults() {
+	atomic.AddUint64(&d.rulesGeneration, 1)
+}
+
+// matchHostCached is matchHost that uses result cache if it's enabled
+func (d *Dnsfilter) matchHostCached(q query) (Result, error) {
+	cache := d.resultCache
+	if cache == nil || q.clientIP != nil || q.clientSubnet != nil {
+		return d.matchHost(q)
+	}
+
+	key := resultCacheKey{host: q.host, qclass: q.qclass, protocol: q.protocol}
+	generation := atomic.LoadUint64(&d.rulesGeneration)
+	if value, err := cache.Get(key); err == nil {
+		entry := value.(resultCacheEntry)
+		if entry.generation == generation {
+			return copyResult(entry.result), nil
+		}
+	}
+
+	result, err := d.matchHost(q)
+	if err != nil {
+		return result, err
+	}
+	// generation was read before matching, so if rules changed meanwhile the entry is already stale
+	cache.Set(key, resultCacheEntry{generation: generation, result: copyResult(result)})
+	return result, nil
+}
+
+// copyResult returns a copy of result that doesn't share DNSRewrite with it
+func copyResult(result Result) Result {
+	if result.DNSRewrite != nil {
+		rewrite := *result.DNSRewrite
+		rewrite.IPs = append([]net.IP(nil), rewrite.IPs...)
+		result.DNSRewrite = &rewrite
+	}
+	return result
+}
@@ -4,9 +4,13 @@ import (
 	"strings"
 )
 
-func ruleToRegexp(rule string) (string, error) {
+// ruleToRegexp converts rule to regular expression, separatorClass is a character class that ^ matches besides end of hostname, if not empty
+func ruleToRegexp(rule string, separatorClass string) (string, error) {
 	const hostStart = `(?:^|\.)`
-	const hostEnd = `$`
+	hostEnd := `$`
+	if separatorClass != "" {
+		hostEnd = `(?:` + separatorClass + `|$)`
+	}
 
 	// empty or short rule -- do nothing
 	if !isValidRule(rule) {
@@ -50,8 +54,23 @@ func ruleToRegexp(rule string) (string, error) {
 	return sb.String(), nil
 }
 
+// hasValidAnchors tells if rule text has no more than one start anchor (| or ||) and one end anchor (|)
+// e.g. |||example.org and ||example.org|| are invalid
+func hasValidAnchors(rule string) bool {
+	if rule[0] == '/' && rule[len(rule)-1] == '/' {
+		return true
+	}
+	leading := len(rule) - len(strings.TrimLeft(rule, "|"))
+	trailing := len(rule) - len(strings.TrimRight(rule, "|"))
+	return leading <= 2 && trailing <= 1 && leading < len(rule)
+}
+
 // handle suffix rule ||example.com^ -- either entire string is example.com or *.example.com
 func getSuffix(rule string) (bool, string) {
+	// shortest suffix rule is ||a^, shorter text may be just anchors
+	if len(rule) < 4 {
+		return false, ""
+	}
 	// if starts with / and ends with /, it's already a regexp
 	// TODO: if a regexp is simple `/abracadabra$/`, then simplify it maybe?
 	if rule[0] == '/' && rule[len(rule)-1] == '/' {
@@ -64,13 +83,17 @@ func getSuffix(rule string) (bool, string) {
 	}
 	rule = rule[2:]
 
-	// suffix rule must end with ^ or |
-	lastChar := rule[len(rule)-1]
-	if lastChar != '^' && lastChar != '|' {
-		return false, ""
+	// suffix rule must end with ^ or |, or both, as end of hostname is a separator too
+	if strings.HasSuffix(rule, "^|") {
+		rule = rule[:len(rule)-2]
+	} else {
+		lastChar := rule[len(rule)-1]
+		if lastChar != '^' && lastChar != '|' {
+			return false, ""
+		}
+		// last char was checked, eat it
+		rule = rule[:len(rule)-1]
 	}
-	// last char was checked, eat it
-	rule = rule[:len(rule)-1]
 
 	// check that it doesn't have any special characters inside
 	for _, r := range rule {
@@ -84,3 +107,25 @@ func getSuffix(rule string) (bool, string) {
 
 	return true, rule
 }
+
+// getPublicSuffixWildcard handles rule ||example.*^ -- example followed by a public suffix, like example.com or example.co.uk, or their subdomains
+func getPublicSuffixWildcard(rule string) (bool, string) {
+	if !strings.HasPrefix(rule, "||") {
+		return false, ""
+	}
+	for _, end := range []string{".*^|", ".*^", ".*|"} {
+		if strings.HasSuffix(rule, end) {
+			isSuffix, name := getSuffix(strings.TrimSuffix(rule, end) + "^")
+			return isSuffix && name != "", name
+		}
+	}
+	return false, ""
+}
+
+// getSubdomainsSuffix handles rule ||*.example.com^ -- any subdomain of example.com, but not example.com itself
+func getSubdomainsSuffix(rule string) (bool, string) {
+	if !strings.HasPrefix(rule, "||*.") {
+		return false, ""
+	}
+	return getSuffix("||" + rule[len("||*."):])
+}
@@ -1,5 +1,134 @@
 package dnsfilter
 
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultSafeSearchCacheTTL = 30 * time.Minute
+
+// safeSearchCache keeps resolved addresses of safesearch replacement hosts
+type safeSearchCache struct {
+	entries map[string]safeSearchCacheEntry
+	ttl     time.Duration
+	sync.Mutex
+}
+
+type safeSearchCacheEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+func defaultResolve(ctx context.Context, host string) ([]net.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, nil
+}
+
+// SafeSearchResult returns addresses of safesearch replacement for search engine host
+// returns nothing if safesearch is disabled or host is not a search engine
+// replacement hosts are resolved lazily and cached, see SetSafeSearchCacheTTL
+func (d *Dnsfilter) SafeSearchResult(host string) ([]net.IP, error) {
+	replacement, ok := d.SafeSearchDomain(host)
+	if !ok {
+		return nil, nil
+	}
+	if ip := net.ParseIP(replacement); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	c := &d.safeSearchCache
+	c.Lock()
+	entry, ok := c.entries[replacement]
+	c.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.ips, nil
+	}
+
+	ips, err := d.resolve(context.Background(), replacement)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Lock()
+	if c.entries == nil {
+		c.entries = map[string]safeSearchCacheEntry{}
+	}
+	c.entries[replacement] = safeSearchCacheEntry{ips: ips, expires: time.Now().Add(c.ttl)}
+	c.Unlock()
+	return ips, nil
+}
+
+// SetResolver lets you optionally replace resolver that is used for resolving hosts, e.g. safesearch replacements
+// nil resets it to net.DefaultResolver
+func (d *Dnsfilter) SetResolver(resolve func(ctx context.Context, host string) ([]net.IP, error)) {
+	if resolve == nil {
+		resolve = defaultResolve
+	}
+	d.resolve = resolve
+	d.SetSafeSearchCacheTTL(d.safeSearchCache.ttl) // drop addresses resolved by previous resolver
+}
+
+// SetSafeSearchCacheTTL lets you optionally change how long resolved addresses of safesearch replacement hosts are cached
+func (d *Dnsfilter) SetSafeSearchCacheTTL(ttl time.Duration) {
+	c := &d.safeSearchCache
+	c.Lock()
+	c.ttl = ttl
+	c.entries = nil
+	c.Unlock()
+}
+
+// SafeSearchTarget is a safesearch replacement of search engine host, either a hostname like forcesafesearch.google.com or an IP address
+type SafeSearchTarget string
+
+// ErrInvalidSafeSearchTarget is returned by SetSafeSearchMapping when mapping has an empty or invalid host or target
+var ErrInvalidSafeSearchTarget = errors.New("dnsfilter: invalid safesearch target")
+
+// SetSafeSearchMapping lets you optionally override or extend built-in table of search engine hosts and their safesearch replacements
+// hosts missing from mapping keep built-in replacements, nil mapping restores the built-in table
+// if mapping has an invalid entry, ErrInvalidSafeSearchTarget is returned and the table is not changed
+func (d *Dnsfilter) SetSafeSearchMapping(mapping map[string]SafeSearchTarget) error {
+	overrides := make(map[string]string, len(mapping))
+	for host, target := range mapping {
+		host = normalizeHost(host)
+		value := strings.TrimSpace(string(target))
+		if host == "" || !isValidHost(host) || value == "" {
+			return ErrInvalidSafeSearchTarget
+		}
+		if net.ParseIP(value) == nil {
+			value = normalizeHost(value)
+			if !isValidHost(value) {
+				return ErrInvalidSafeSearchTarget
+			}
+		}
+		overrides[host] = value
+	}
+	if len(overrides) == 0 {
+		overrides = nil
+	}
+	d.config.safeSearchMapping = overrides
+	return nil
+}
+
+// safeSearchReplacement looks up normalized host in safesearch overrides and then in the built-in table
+func (d *Dnsfilter) safeSearchReplacement(host string) (string, bool) {
+	if val, ok := d.config.safeSearchMapping[host]; ok {
+		return val, true
+	}
+	val, ok := safeSearchDomains[host]
+	return val, ok
+}
+
 var safeSearchDomains = map[string]string{
 	"yandex.com": "213.180.193.56",
 	"yandex.ru":  "213.180.193.56",
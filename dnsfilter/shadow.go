@@ -0,0 +1,190 @@
+package dnsfilter
+
+import (
+	"sort"
+	"strings"
+)
+
+// ShadowReport describes a rule that can never decide a check because another rule always wins over it
+type ShadowReport struct {
+	Rule       RuleInfo // rule that is unreachable
+	ShadowedBy RuleInfo // rule that matches every host Rule matches and takes precedence
+}
+
+// FindShadowedRules returns enabled rules that are fully covered by a rule of the same or higher precedence
+// e.g. `||example.org^` shadows `||sub.example.org^`, and `@@||example.org^` shadows `||ads.example.org^`
+// this is a heuristic for filter list maintainers: only domain suffix rules are analyzed and precedence set by SetFilterPriority is not taken into account
+func (d *Dnsfilter) FindShadowedRules() []ShadowReport {
+	bySuffix := map[string][]*rule{}
+	d.storageMutex.RLock()
+	for _, rule := range d.storage {
+		suffix, ok := shadowSuffix(rule)
+		if ok {
+			bySuffix[suffix] = append(bySuffix[suffix], rule)
+		}
+	}
+	d.storageMutex.RUnlock()
+
+	reports := []ShadowReport{}
+	for suffix, rules := range bySuffix {
+		for _, shadowed := range rules {
+			var best *rule
+			// walk from the rule's own domain up to its parent domains
+			for domain := suffix; ; {
+				for _, candidate := range bySuffix[domain] {
+					if candidate == shadowed || !shadows(candidate, shadowed, domain == suffix) {
+						continue
+					}
+					if best == nil || precedence(candidate) < precedence(best) || (precedence(candidate) == precedence(best) && candidate.id < best.id) {
+						best = candidate
+					}
+				}
+				i := strings.IndexByte(domain, '.')
+				if i < 0 {
+					break
+				}
+				domain = domain[i+1:]
+			}
+			if best != nil {
+				reports = append(reports, ShadowReport{Rule: shadowed.info(), ShadowedBy: best.info()})
+			}
+		}
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Rule.ID < reports[j].Rule.ID })
+	return reports
+}
+
+// shadowSuffix returns lowercased domain of an enabled suffix rule
+func shadowSuffix(rule *rule) (string, bool) {
+	if rule.network != nil || rule.isDisabled() {
+		return "", false
+	}
+	isSuffix, suffix := getSuffix(rule.text)
+	if !isSuffix {
+		return "", false
+	}
+	return strings.ToLower(suffix), true
+}
+
+// precedence returns order in which rules tables are checked, lower goes first
+func precedence(rule *rule) int {
+	if rule.isImportant && rule.isWhitelist {
+		return 0
+	} else if rule.isImportant {
+		return 1
+	} else if rule.isWhitelist {
+		return 2
+	}
+	return 3
+}
+
+// shadows tells if rule a decides every check that rule b could decide
+// sameDomain is true if both rules have the same domain, then only the later added rule is considered shadowed
+func shadows(a, b *rule, sameDomain bool) bool {
+	if precedence(a) > precedence(b) || len(a.clients) != 0 || len(a.domains) != 0 || len(a.excluded) != 0 || a.minLabels != 0 || a.hasLabels {
+		return false
+	}
+	if a.badfilter != "" {
+		// $badfilter rules only disable other rules and never match
+		return false
+	}
+	if precedence(a) == precedence(b) {
+		if a.isWhitelist != b.isWhitelist || !sameRewrite(a.rewrite, b.rewrite) {
+			// both can match, but give different results
+			return false
+		}
+		if sameDomain && a.id > b.id && sameClasses(a.classes, b.classes) {
+			return false
+		}
+	}
+	// a must apply to every protocol b applies to
+	if len(a.protocols) != 0 {
+		if len(b.protocols) == 0 {
+			return false
+		}
+		for _, p := range b.protocols {
+			if !a.matchProtocol(p) {
+				return false
+			}
+		}
+	}
+	// a must apply to every DNS class b applies to
+	if len(a.classes) == 0 {
+		return true
+	}
+	if len(b.classes) == 0 {
+		return false
+	}
+	for _, c := range b.classes {
+		if !a.matchClass(c) {
+			return false
+		}
+	}
+	return true
+}
+
+func sameRewrite(a, b *DNSRewrite) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.RCode != b.RCode || len(a.IPs) != len(b.IPs) {
+		return false
+	}
+	for i := range a.IPs {
+		if !a.IPs[i].Equal(b.IPs[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func sameClasses(a, b []uint16) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, c := range a {
+		found := false
+		for _, other := range b {
+			if c == other {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// NearMatches returns domain suffix rules that contain hostname's domain or are contained in it, but don't match it because of domain boundary
+// e.g. `||click.net^` for doubleclick.net or `||doubleclick.net^` for doubleclick.net.ru, this is meant for diagnostics only
+func (d *Dnsfilter) NearMatches(hostname string) []string {
+	host := normalizeHost(hostname)
+	near := []string{}
+	if host == "" {
+		return near
+	}
+	for _, table := range d.tables() {
+		table.RLock()
+		// shortcuts found in host point to rules whose text is likely to be a part of host
+		table.walk(host, true, func(rule *rule) bool {
+			isSuffix, suffix := getSuffix(rule.text)
+			if !isSuffix || rule.network != nil {
+				return false
+			}
+			suffix = strings.ToLower(suffix)
+			if host == suffix || strings.HasSuffix(host, "."+suffix) {
+				// matches, not a near miss
+				return false
+			}
+			if strings.Contains(host, suffix) {
+				near = append(near, rule.originalText)
+			}
+			return false
+		})
+		table.RUnlock()
+	}
+	sort.Strings(near)
+	return near
+}
@@ -0,0 +1,86 @@
+package dnsfilter
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const warmupConcurrency = 16 // maximum number of lookups done by Warmup at the same time
+
+// WarmupError holds errors of the lookups that failed during Warmup, keyed by hostname
+type WarmupError map[string]error
+
+func (e WarmupError) Error() string {
+	errs := make([]string, 0, len(e))
+	for host, err := range e {
+		errs = append(errs, fmt.Sprintf("%s: %v", host, err))
+	}
+	return fmt.Sprintf("dnsfilter: warmup failed for %d hosts: %s", len(e), strings.Join(errs, "; "))
+}
+
+// Warmup does safebrowsing and parental lookups for hosts, if they are enabled, so that their results are cached before the first real queries
+// lookups are done concurrently, when ctx is cancelled in-flight lookups are aborted, hosts that are not started yet are skipped and ctx.Err() is returned
+// if some lookups failed, returned error is WarmupError
+func (d *Dnsfilter) Warmup(ctx context.Context, hosts []string) error {
+	var (
+		wg    sync.WaitGroup
+		mutex sync.Mutex
+		errs  = WarmupError{}
+	)
+	limit := make(chan struct{}, warmupConcurrency)
+	for _, host := range hosts {
+		host = normalizeHost(host)
+		if host == "" {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+		case limit <- struct{}{}:
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(host string) {
+			defer func() {
+				<-limit
+				wg.Done()
+			}()
+			err := d.warmupHost(ctx, host)
+			if err != nil {
+				mutex.Lock()
+				errs[host] = err
+				mutex.Unlock()
+			}
+		}(host)
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
+
+// warmupHost does lookups for a single host, unlike checkHost it reports lookup errors
+func (d *Dnsfilter) warmupHost(ctx context.Context, host string) error {
+	if isFlagSet(&d.safeBrowsingEnabled) {
+		_, err := d.checkSafeBrowsing(ctx, host)
+		if err != nil {
+			return err
+		}
+	}
+	if isFlagSet(&d.parentalEnabled) {
+		_, err := d.checkParental(ctx, host)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}